@@ -1,26 +1,39 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/sgrzywna/statuslight/internal/app/jenkinsstatus"
+	"github.com/sgrzywna/statuslight/internal/app/statuslight"
 	"github.com/sgrzywna/statuslight/internal/app/statuslightclient"
 )
 
 // config stores jenkinsstatus configuration.
 type config struct {
-	StatusLight statuslight `toml:"statuslight"`
+	StatusLight statusLight `toml:"statuslight"`
 	Jenkins     jenkins     `toml:"jenkins"`
 	Jobs        []job       `toml:"job"`
 }
 
-// statuslight stores statuslight daemon configuration.
-type statuslight struct {
-	URL string `toml:"url"`
+// statusLight stores statuslight daemon configuration.
+type statusLight struct {
+	URL   string `toml:"url"`
+	Group string `toml:"group"`
+	// Token is the API token, it is required when statuslight daemon authenticates requests.
+	Token string `toml:"token"`
+	// CAFile verifies certificate of statuslight daemon served over HTTPS, system CAs are used when empty.
+	CAFile string `toml:"ca_file"`
+	// CertFile and KeyFile are the client certificate, it is sent when statuslight daemon verifies clients.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
 }
 
 // jenkins stores Jenkins configuration.
@@ -40,23 +53,48 @@ type job struct {
 // jenkinsStatusReceiver implements jenkinsstatus.Receiver interface.
 type jenkinsStatusReceiver struct {
 	client *statuslightclient.Client
+	group  string
 }
 
-func (r *jenkinsStatusReceiver) OnStatus(job []string, status string) {
-	var sts bool
+// OnStatuses sends statuses of all jobs to the status light daemon in single batch.
+func (r *jenkinsStatusReceiver) OnStatuses(ctx context.Context, statuses []jenkinsstatus.JobStatus) {
+	var batch []statuslight.StatusV2
+
+	for _, s := range statuses {
+		var state string
+
+		switch s.Status {
+		case "SUCCESS":
+			state = "ok"
+		case "UNSTABLE":
+			state = "unstable"
+		case "FAILURE":
+			state = "error"
+		case "RUNNING":
+			state = "running"
+		case "ABORTED":
+			state = "unknown"
+		case "NOT_BUILT":
+			state = "disabled"
+		default:
+			log.Printf("jenkinsStatusReceiver.OnStatuses unsupported status: %s for %v", s.Status, s.Job)
+			continue
+		}
 
-	switch status {
-	case "ABORTED", "FAILURE", "NOT_BUILT", "UNSTABLE":
-	case "SUCCESS":
-		sts = true
-	default:
-		log.Printf("jenkinsStatusReceiver.OnStatus unsupported status: %s", status)
+		batch = append(batch, statuslight.StatusV2{
+			State: state,
+			ID:    strings.Join(s.Job, "/"),
+			Group: r.group,
+		})
+	}
+
+	if len(batch) == 0 {
 		return
 	}
 
-	err := r.client.SetStatus(strings.Join(job, "/"), sts)
+	err := r.client.SetStatuses(ctx, batch)
 	if err != nil {
-		log.Printf("jenkinsStatusReceiver.OnStatus error: %s", err)
+		log.Printf("jenkinsStatusReceiver.OnStatuses error: %s", err)
 	}
 }
 
@@ -76,9 +114,23 @@ func main() {
 	}
 
 	statusLightClient := statuslightclient.NewClient(cfg.StatusLight.URL)
+	if cfg.StatusLight.Token != "" {
+		statusLightClient.SetToken(cfg.StatusLight.Token)
+	}
+	if cfg.StatusLight.CAFile != "" || cfg.StatusLight.CertFile != "" || cfg.StatusLight.KeyFile != "" {
+		err = statusLightClient.SetTLS(statuslightclient.TLSOptions{
+			CAFile:   cfg.StatusLight.CAFile,
+			CertFile: cfg.StatusLight.CertFile,
+			KeyFile:  cfg.StatusLight.KeyFile,
+		})
+		if err != nil {
+			log.Fatalf("statuslight tls error: %s", err)
+		}
+	}
 
 	rcv := jenkinsStatusReceiver{
 		client: statusLightClient,
+		group:  cfg.StatusLight.Group,
 	}
 
 	var jobs [][]string
@@ -98,8 +150,16 @@ func main() {
 		jobs = append(jobs, path)
 	}
 
-	jenkinsStatus := jenkinsstatus.NewJenkinsStatus(jenkins, jobs, time.Duration(cfg.Jenkins.CheckPeriod)*time.Second, &rcv)
-	defer jenkinsStatus.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	jenkinsStatus := jenkinsstatus.NewJenkinsStatus(ctx, jenkins, jobs, time.Duration(cfg.Jenkins.CheckPeriod)*time.Second, &rcv)
+
+	sig := <-signals
+	log.Printf("%s received, shutting down", sig)
 
-	select {}
+	jenkinsStatus.Close()
 }
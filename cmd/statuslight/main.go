@@ -1,43 +1,424 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/sgrzywna/milightd/pkg/models"
 	"github.com/sgrzywna/statuslight/internal/app/statuslight"
 )
 
+// config stores statuslight configuration loaded from the file.
+type config struct {
+	Groups      []group      `toml:"group"`
+	Schedule    schedule     `toml:"schedule"`
+	Escalations []escalation `toml:"escalation"`
+	Sequences   []sequence   `toml:"sequence"`
+}
+
+// sequence stores definition of milightd sequence.
+type sequence struct {
+	Name  string `toml:"name"`
+	Steps []step `toml:"step"`
+}
+
+// step stores single step of milightd sequence.
+type step struct {
+	Color      string `toml:"color"`
+	Brightness int    `toml:"brightness"`
+	Switch     string `toml:"switch"`
+	Duration   int    `toml:"duration"`
+}
+
+// escalation stores configuration of the escalation rule.
+type escalation struct {
+	Status     string `toml:"status"`
+	After      string `toml:"after"`
+	Color      string `toml:"color"`
+	Sequence   string `toml:"sequence"`
+	Brightness int    `toml:"brightness"`
+}
+
+// schedule stores working hours configuration.
+type schedule struct {
+	Timezone        string   `toml:"timezone"`
+	QuietColor      string   `toml:"quiet_color"`
+	QuietBrightness int      `toml:"quiet_brightness"`
+	Periods         []period `toml:"period"`
+}
+
+// period stores working hours on the week days.
+type period struct {
+	Days  []string `toml:"days"`
+	Start string   `toml:"start"`
+	End   string   `toml:"end"`
+}
+
+// group stores configuration of the status group light.
+type group struct {
+	Name       string            `toml:"name"`
+	Driver     string            `toml:"driver"`
+	URL        string            `toml:"url"`
+	Colors     map[string]string `toml:"colors"`
+	Sequences  map[string]string `toml:"sequences"`
+	Brightness int               `toml:"brightness"`
+}
+
 func main() {
+	var cfgPath = flag.String("config", "", "full path to the optional configuration file with status groups")
+	var driver = flag.String("driver", "milightd", "light driver: milightd, log or noop")
 	var miURL = flag.String("miurl", "http://127.0.0.1:8080", "milightd URL")
 	var port = flag.Int("port", 8888, "listening port")
 	var okColor = flag.String("ok-color", "green", "color for the OK status")
 	var unstableColor = flag.String("unstable-color", "yellow", "color for the unstable status")
 	var errorColor = flag.String("error-color", "red", "color for the error status")
+	var runningColor = flag.String("running-color", "blue", "color for the running status")
+	var unknownColor = flag.String("unknown-color", "white", "color for the unknown status")
+	var disabledColor = flag.String("disabled-color", "off", "color for the disabled status, off switches the light off")
 	var okSeq = flag.String("ok-seq", "", "sequence for the OK status")
 	var unstableSeq = flag.String("unstable-seq", "", "sequence for the unstable status")
 	var errorSeq = flag.String("error-seq", "", "sequence for the error status")
+	var runningSeq = flag.String("running-seq", "", "sequence for the running status")
+	var unknownSeq = flag.String("unknown-seq", "", "sequence for the unknown status")
+	var disabledSeq = flag.String("disabled-seq", "", "sequence for the disabled status")
 	var brightness = flag.Int("brightness", 32, "brightness level")
+	var ttl = flag.Int("ttl", 0, "default status time-to-live in seconds, 0 disables expiration")
+	var policy = flag.String("policy", "mixed", "aggregation policy: mixed, worst, best, majority or threshold")
+	var threshold = flag.Int("threshold", 50, "percentage of error statuses turning the light to error for the threshold policy")
+	var stateFile = flag.String("state-file", "", "full path to the file storing statuses across restarts, empty disables persistence")
+	var stateMaxAge = flag.Int("state-max-age", 0, "age in seconds above which statuses from the state file are dropped, 0 keeps all statuses")
+	var debounce = flag.Int("debounce", 500, "time in milliseconds to collect status changes before the light is updated")
+	var minInterval = flag.Int("min-interval", 1000, "minimal interval in milliseconds between light updates")
+	var maxStatuses = flag.Int("max-statuses", 16, "maximal number of different statuses")
+	var eviction = flag.String("eviction", "reject", "policy for new statuses when there are already max-statuses: reject, lru or expired")
+	var retryMax = flag.Int("retry-max", 300, "maximal delay in seconds between retries of failed light commands")
+	var reassert = flag.Int("reassert", 0, "period in minutes of re-sending current status to the light, 0 disables re-sending")
+	var offlineColor = flag.String("offline-color", "", "color set on exit, empty leaves the light unchanged")
+	var offlineSeq = flag.String("offline-seq", "", "sequence run on exit")
+	var staleAfter = flag.Int("stale-after", 0, "time in seconds without any status update after which the light shows stale data, 0 disables watchdog")
+	var staleColor = flag.String("stale-color", "purple", "color showing stale data")
+	var staleSeq = flag.String("stale-seq", "", "sequence showing stale data")
+	var tokensPath = flag.String("tokens", "", "full path to the file with API tokens, empty disables authentication")
+	var signingKeysPath = flag.String("signing-keys", "", "full path to the file with keys of signed status submissions, empty disables signing")
+	var signatureWindow = flag.Int("signature-window", 300, "time in seconds by which signature timestamp can differ from the current time")
+	var tlsCert = flag.String("tls-cert", "", "full path to the PEM encoded server certificate, empty disables TLS, reloaded on SIGHUP")
+	var tlsKey = flag.String("tls-key", "", "full path to the PEM encoded server private key, reloaded on SIGHUP")
+	var tlsClientCA = flag.String("tls-client-ca", "", "full path to the PEM encoded CA certificates verifying client certificates, empty disables client certificates")
+	var tlsRequireClientCert = flag.Bool("tls-require-client-cert", false, "reject connections without valid client certificate")
+	var tlsClientACL = flag.String("tls-client-acl", "", "full path to the file with permissions of client certificates")
 
 	flag.Parse()
 
-	statusLight := statuslight.NewStatusLight(
-		*miURL,
-		statuslight.StatusMap{
+	aggregator, err := statuslight.NewAggregator(*policy, *threshold)
+	if err != nil {
+		log.Fatalf("configuration error: %s", err)
+	}
+
+	evictionPolicy, err := statuslight.ParseEvictionPolicy(*eviction)
+	if err != nil {
+		log.Fatalf("configuration error: %s", err)
+	}
+
+	// default group is configured with command line switches
+	defaultGroup := statuslight.GroupConfig{
+		Name:   statuslight.DefaultGroup,
+		Driver: *driver,
+		URL:    *miURL,
+		Colors: statuslight.StatusMap{
 			statuslight.StatusOK:       *okColor,
 			statuslight.StatusUnstable: *unstableColor,
 			statuslight.StatusError:    *errorColor,
+			statuslight.StatusRunning:  *runningColor,
+			statuslight.StatusUnknown:  *unknownColor,
+			statuslight.StatusDisabled: *disabledColor,
 		},
-		statuslight.StatusMap{
+		Sequences: statuslight.StatusMap{
 			statuslight.StatusOK:       *okSeq,
 			statuslight.StatusUnstable: *unstableSeq,
 			statuslight.StatusError:    *errorSeq,
+			statuslight.StatusRunning:  *runningSeq,
+			statuslight.StatusUnknown:  *unknownSeq,
+			statuslight.StatusDisabled: *disabledSeq,
 		},
-		*brightness,
-	)
-	defer statusLight.Close()
+		Brightness: *brightness,
+	}
+
+	var cfg config
+	if *cfgPath != "" {
+		if _, err = toml.DecodeFile(*cfgPath, &cfg); err != nil {
+			log.Fatalf("configuration error: %s", err)
+		}
+	}
+
+	groups, err := loadGroups(cfg, defaultGroup)
+	if err != nil {
+		log.Fatalf("configuration error: %s", err)
+	}
+
+	schedule, err := loadSchedule(cfg)
+	if err != nil {
+		log.Fatalf("configuration error: %s", err)
+	}
+
+	escalations, err := loadEscalations(cfg)
+	if err != nil {
+		log.Fatalf("configuration error: %s", err)
+	}
+
+	var tokens *statuslight.Tokens
+	if *tokensPath != "" {
+		tokens, err = statuslight.LoadTokens(*tokensPath)
+		if err != nil {
+			log.Fatalf("tokens error: %s", err)
+		}
+	}
+
+	if *tlsCert == "" && (*tlsClientCA != "" || *tlsClientACL != "") {
+		log.Fatalf("configuration error: client certificates require -tls-cert")
+	}
+	if *tlsClientACL != "" && *tlsClientCA == "" {
+		log.Fatalf("configuration error: -tls-client-acl requires -tls-client-ca")
+	}
+
+	var clientACL *statuslight.ClientACL
+	if *tlsClientACL != "" {
+		clientACL, err = statuslight.LoadClientACL(*tlsClientACL)
+		if err != nil {
+			log.Fatalf("client ACL error: %s", err)
+		}
+	}
+
+	var signingKeys *statuslight.SigningKeys
+	if *signingKeysPath != "" {
+		signingKeys, err = statuslight.LoadSigningKeys(*signingKeysPath)
+		if err != nil {
+			log.Fatalf("signing keys error: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("%s received, shutting down", sig)
+		cancel()
+	}()
+
+	statusLight, err := statuslight.NewStatusLight(ctx, statuslight.Config{
+		Groups:          groups,
+		TTL:             time.Duration(*ttl) * time.Second,
+		Aggregator:      aggregator,
+		StateFile:       *stateFile,
+		StateMaxAge:     time.Duration(*stateMaxAge) * time.Second,
+		Debounce:        time.Duration(*debounce) * time.Millisecond,
+		MinInterval:     time.Duration(*minInterval) * time.Millisecond,
+		MaxStatuses:     *maxStatuses,
+		Eviction:        evictionPolicy,
+		RetryMax:        time.Duration(*retryMax) * time.Second,
+		Reassert:        time.Duration(*reassert) * time.Minute,
+		Schedule:        schedule,
+		Escalations:     escalations,
+		OfflineColor:    *offlineColor,
+		OfflineSequence: *offlineSeq,
+		StaleAfter:      time.Duration(*staleAfter) * time.Second,
+		StaleColor:      *staleColor,
+		StaleSequence:   *staleSeq,
+
+		SequenceDefinitions: loadSequences(cfg),
+	})
+	if err != nil {
+		log.Fatalf("statuslight error: %s", err)
+	}
 
 	srv := statuslight.NewHTTPServer(*port, statusLight)
+	if tokens != nil {
+		srv.SetTokens(tokens)
+	}
+	if signingKeys != nil {
+		srv.SetSigningKeys(signingKeys, time.Duration(*signatureWindow)*time.Second)
+	}
+	if clientACL != nil {
+		srv.SetClientACL(clientACL)
+	}
+	if *tlsCert != "" {
+		err = srv.SetTLS(statuslight.TLSConfig{
+			CertFile:          *tlsCert,
+			KeyFile:           *tlsKey,
+			ClientCAFile:      *tlsClientCA,
+			RequireClientCert: *tlsRequireClientCert,
+		})
+		if err != nil {
+			log.Fatalf("tls error: %s", err)
+		}
+
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		go func() {
+			for range reloads {
+				if err := srv.ReloadTLS(); err != nil {
+					log.Printf("tls reload error: %s", err)
+					continue
+				}
+				log.Printf("tls certificate reloaded")
+			}
+		}()
+	}
 
 	log.Printf("statuslight listening @ :%d\n", *port)
-	log.Fatal(srv.ListenAndServe())
+	err = srv.ListenAndServe(ctx)
+
+	// stop status loop also when HTTP server failed
+	cancel()
+	statusLight.Close()
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	log.Printf("statuslight stopped")
+}
+
+// loadGroups returns status groups from the configuration file.
+// Settings missing in the file are taken from the default group,
+// default group is used alone when there are no groups in the file.
+func loadGroups(cfg config, defaultGroup statuslight.GroupConfig) ([]statuslight.GroupConfig, error) {
+	if len(cfg.Groups) == 0 {
+		return []statuslight.GroupConfig{defaultGroup}, nil
+	}
+
+	var groups []statuslight.GroupConfig
+
+	for _, g := range cfg.Groups {
+		if g.Name == "" {
+			return nil, errors.New("group without name")
+		}
+		colors, err := mergeStatusMap(defaultGroup.Colors, g.Colors)
+		if err != nil {
+			return nil, err
+		}
+		sequences, err := mergeStatusMap(defaultGroup.Sequences, g.Sequences)
+		if err != nil {
+			return nil, err
+		}
+		groupCfg := statuslight.GroupConfig{
+			Name:       g.Name,
+			Driver:     g.Driver,
+			URL:        g.URL,
+			Colors:     colors,
+			Sequences:  sequences,
+			Brightness: g.Brightness,
+		}
+		if groupCfg.Driver == "" {
+			groupCfg.Driver = defaultGroup.Driver
+		}
+		if groupCfg.URL == "" {
+			groupCfg.URL = defaultGroup.URL
+		}
+		if groupCfg.Brightness == 0 {
+			groupCfg.Brightness = defaultGroup.Brightness
+		}
+		log.Printf("Loading group '%s' (%s)", groupCfg.Name, groupCfg.URL)
+		groups = append(groups, groupCfg)
+	}
+
+	return groups, nil
+}
+
+// loadSchedule returns working hours schedule from the configuration file,
+// nil schedule is returned when there are no working hours defined.
+func loadSchedule(cfg config) (*statuslight.Schedule, error) {
+	if len(cfg.Schedule.Periods) == 0 {
+		return nil, nil
+	}
+
+	schedule, err := statuslight.NewSchedule(cfg.Schedule.Timezone, cfg.Schedule.QuietColor, cfg.Schedule.QuietBrightness)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range cfg.Schedule.Periods {
+		err = schedule.AddPeriod(p.Days, p.Start, p.End)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return schedule, nil
+}
+
+// loadEscalations returns escalation rules from the configuration file.
+func loadEscalations(cfg config) ([]statuslight.EscalationRule, error) {
+	var rules []statuslight.EscalationRule
+
+	for _, e := range cfg.Escalations {
+		after, err := time.ParseDuration(e.After)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, statuslight.EscalationRule{
+			Status:     e.Status,
+			After:      after,
+			Color:      e.Color,
+			Sequence:   e.Sequence,
+			Brightness: e.Brightness,
+		})
+	}
+
+	return rules, nil
+}
+
+// loadSequences returns milightd sequence definitions from the configuration file.
+func loadSequences(cfg config) []models.Sequence {
+	var sequences []models.Sequence
+
+	for _, s := range cfg.Sequences {
+		seq := models.Sequence{
+			Name: s.Name,
+		}
+		for _, st := range s.Steps {
+			var light models.Light
+			if st.Color != "" {
+				light.SetColor(st.Color)
+			}
+			if st.Brightness > 0 {
+				light.SetBrightness(st.Brightness)
+			}
+			if st.Switch != "" {
+				light.SetSwitch(st.Switch == models.On)
+			}
+			seq.Steps = append(seq.Steps, models.SequenceStep{
+				Light:    light,
+				Duration: st.Duration,
+			})
+		}
+		sequences = append(sequences, seq)
+	}
+
+	return sequences
+}
+
+// mergeStatusMap returns copy of the base status map updated with the named overrides.
+func mergeStatusMap(base statuslight.StatusMap, overrides map[string]string) (statuslight.StatusMap, error) {
+	m, err := statuslight.NewStatusMap(overrides)
+	if err != nil {
+		return nil, err
+	}
+	res := make(statuslight.StatusMap)
+	for t, action := range base {
+		res[t] = action
+	}
+	for t, action := range m {
+		res[t] = action
+	}
+	return res, nil
 }
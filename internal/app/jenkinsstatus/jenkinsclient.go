@@ -1,6 +1,10 @@
 package jenkinsstatus
 
-import "github.com/bndr/gojenkins"
+import (
+	"context"
+
+	"github.com/bndr/gojenkins"
+)
 
 // JenkinsClient represents Jenkins client high level interface.
 type JenkinsClient struct {
@@ -20,8 +24,28 @@ func NewJenkinsClient(url, username, password string) (*JenkinsClient, error) {
 }
 
 // GetStatus returns build status for the specified Jenkins job.
-// Returned status can be ABORTED, FAILURE, NOT_BUILT, SUCCESS, UNSTABLE.
-func (c *JenkinsClient) GetStatus(id string, parentIDs ...string) (string, error) {
+// Returned status can be ABORTED, FAILURE, NOT_BUILT, RUNNING, SUCCESS, UNSTABLE.
+// Jenkins client doesn't support contexts, so canceled call is abandoned in the background.
+func (c *JenkinsClient) GetStatus(ctx context.Context, id string, parentIDs ...string) (string, error) {
+	type result struct {
+		status string
+		err    error
+	}
+	res := make(chan result, 1)
+	go func() {
+		status, err := c.getStatus(id, parentIDs...)
+		res <- result{status, err}
+	}()
+	select {
+	case r := <-res:
+		return r.status, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// getStatus returns build status for the specified Jenkins job.
+func (c *JenkinsClient) getStatus(id string, parentIDs ...string) (string, error) {
 	job, err := c.jenkins.GetJob(id, parentIDs...)
 	if err != nil {
 		return "", err
@@ -30,5 +54,10 @@ func (c *JenkinsClient) GetStatus(id string, parentIDs ...string) (string, error
 	if err != nil {
 		return "", err
 	}
-	return build.GetResult(), nil
+	result := build.GetResult()
+	if result == "" {
+		// build in progress has no result yet
+		return "RUNNING", nil
+	}
+	return result, nil
 }
@@ -1,13 +1,16 @@
 package jenkinsstatus
 
-import "testing"
+import (
+	"context"
+	"testing"
+)
 
 func TestJenkinsGetStatus(t *testing.T) {
 	jenkins, err := NewJenkinsClient("http://127.0.0.1:8080", "admin", "admin")
 	if err != nil {
 		t.Fatal(err)
 	}
-	sts, err := jenkins.GetStatus("first", "parent")
+	sts, err := jenkins.GetStatus(context.Background(), "first", "parent")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1,13 +1,23 @@
 package jenkinsstatus
 
 import (
+	"context"
 	"log"
 	"time"
 )
 
+// JobStatus stores status of the Jenkins job.
+type JobStatus struct {
+	// Job is the job path, job name is followed by the names of parent folders.
+	Job    []string
+	Status string
+}
+
 // Receiver represents receiver of Jenkins job statuses.
 type Receiver interface {
-	OnStatus(job []string, status string)
+	// OnStatuses receives statuses of all jobs checked in single probing cycle,
+	// it should return when the context is canceled.
+	OnStatuses(ctx context.Context, statuses []JobStatus)
 }
 
 // JenkinsStatus represents Jenkins high level client.
@@ -16,50 +26,68 @@ type JenkinsStatus struct {
 	jobs        [][]string
 	checkPeriod time.Duration
 	rcv         Receiver
-	close       chan bool
+	// cancel stops probing loop, done is closed when probing loop ends.
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 // NewJenkinsStatus returns initialized JenkinsStatus object.
-func NewJenkinsStatus(jenkins *JenkinsClient, jobs [][]string, checkPeriod time.Duration, rcv Receiver) *JenkinsStatus {
+// Probing loop runs until the context is canceled or JenkinsStatus is closed.
+func NewJenkinsStatus(ctx context.Context, jenkins *JenkinsClient, jobs [][]string, checkPeriod time.Duration, rcv Receiver) *JenkinsStatus {
 	jenkinsStatus := JenkinsStatus{
 		jenkins:     jenkins,
 		jobs:        jobs,
 		checkPeriod: checkPeriod,
 		rcv:         rcv,
-		close:       make(chan bool),
+		done:        make(chan struct{}),
 	}
-	go jenkinsStatus.probeLoop()
+	ctx, jenkinsStatus.cancel = context.WithCancel(ctx)
+	go jenkinsStatus.probeLoop(ctx)
 	return &jenkinsStatus
 }
 
-// Close stops probing loop.
+// Close stops probing loop, it cancels probing in progress and waits until the loop ends.
 func (s *JenkinsStatus) Close() {
-	s.close <- true
+	s.cancel()
+	<-s.done
 }
 
 // probeLoop is the main processing loop.
-func (s *JenkinsStatus) probeLoop() {
+func (s *JenkinsStatus) probeLoop(ctx context.Context) {
+	defer close(s.done)
+
 	// check status immediately
-	s.checkStatus()
+	s.checkStatus(ctx)
+
+	ticker := time.NewTicker(s.checkPeriod)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.close:
+		case <-ctx.Done():
 			return
-		case <-time.After(s.checkPeriod):
-			s.checkStatus()
+		case <-ticker.C:
+			s.checkStatus(ctx)
 		}
 	}
 }
 
-// checkStatus probes jenkins for job status
-func (s *JenkinsStatus) checkStatus() {
+// checkStatus probes jenkins for status of all jobs and passes them to the receiver at once.
+// Jobs which status cannot be read are skipped.
+func (s *JenkinsStatus) checkStatus(ctx context.Context) {
+	var statuses []JobStatus
 	for _, job := range s.jobs {
-		sts, err := s.jenkins.GetStatus(job[0], job[1:]...)
+		if ctx.Err() != nil {
+			return
+		}
+		sts, err := s.jenkins.GetStatus(ctx, job[0], job[1:]...)
 		if err != nil {
 			log.Printf("jenkins.GetStatus error: %s for %v", err, job)
-		} else {
-			s.rcv.OnStatus(job, sts)
+			continue
 		}
+		statuses = append(statuses, JobStatus{Job: job, Status: sts})
+	}
+	if len(statuses) > 0 {
+		s.rcv.OnStatuses(ctx, statuses)
 	}
 }
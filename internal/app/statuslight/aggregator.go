@@ -0,0 +1,137 @@
+package statuslight
+
+import "fmt"
+
+// Aggregator represents policy calculating single status from all received statuses.
+type Aggregator interface {
+	// Aggregate returns single status for the number of received statuses of each type.
+	Aggregate(counts map[statusType]int) statusType
+}
+
+// severity stores order of the status types, from the best to the worst one.
+var severity = []statusType{
+	StatusOK,
+	StatusRunning,
+	StatusUnknown,
+	StatusUnstable,
+	StatusError,
+}
+
+// NewAggregator returns aggregation policy with the specified name.
+// Supported policies are: mixed, worst, best, majority and threshold.
+// Threshold is the percentage of error statuses used by the threshold policy.
+func NewAggregator(name string, threshold int) (Aggregator, error) {
+	switch name {
+	case "mixed":
+		return mixedAggregator{}, nil
+	case "worst":
+		return worstWinsAggregator{}, nil
+	case "best":
+		return bestWinsAggregator{}, nil
+	case "majority":
+		return majorityAggregator{}, nil
+	case "threshold":
+		if threshold < 0 || threshold > 100 {
+			return nil, fmt.Errorf("threshold out of range: %d", threshold)
+		}
+		return thresholdAggregator{percent: threshold}, nil
+	}
+	return nil, fmt.Errorf("unknown aggregation policy: %s", name)
+}
+
+// mixedAggregator gives ok status when all statuses are ok, error status
+// when all statuses are errors, and unstable status otherwise.
+type mixedAggregator struct{}
+
+// Aggregate implements Aggregator interface.
+func (mixedAggregator) Aggregate(counts map[statusType]int) statusType {
+	switch {
+	case counts[StatusUnstable] > 0:
+		return StatusUnstable
+	case counts[StatusOK] > 0 && counts[StatusError] > 0:
+		return StatusUnstable
+	case counts[StatusError] > 0:
+		return StatusError
+	case counts[StatusOK] > 0:
+		return StatusOK
+	}
+	return idleStatus(counts)
+}
+
+// worstWinsAggregator gives the worst of received statuses.
+type worstWinsAggregator struct{}
+
+// Aggregate implements Aggregator interface.
+func (worstWinsAggregator) Aggregate(counts map[statusType]int) statusType {
+	for i := len(severity) - 1; i >= 0; i-- {
+		if counts[severity[i]] > 0 {
+			return severity[i]
+		}
+	}
+	return idleStatus(counts)
+}
+
+// bestWinsAggregator gives the best of received statuses.
+type bestWinsAggregator struct{}
+
+// Aggregate implements Aggregator interface.
+func (bestWinsAggregator) Aggregate(counts map[statusType]int) statusType {
+	for _, t := range severity {
+		if counts[t] > 0 {
+			return t
+		}
+	}
+	return idleStatus(counts)
+}
+
+// majorityAggregator gives the most common of received statuses, the worse status wins a tie.
+type majorityAggregator struct{}
+
+// Aggregate implements Aggregator interface.
+func (majorityAggregator) Aggregate(counts map[statusType]int) statusType {
+	res, max := StatusOK, 0
+	for _, t := range severity {
+		if counts[t] > 0 && counts[t] >= max {
+			res, max = t, counts[t]
+		}
+	}
+	if max == 0 {
+		return idleStatus(counts)
+	}
+	return res
+}
+
+// thresholdAggregator gives error status when percentage of error statuses
+// reaches the threshold, and behaves like mixedAggregator otherwise.
+type thresholdAggregator struct {
+	percent int
+}
+
+// Aggregate implements Aggregator interface.
+func (a thresholdAggregator) Aggregate(counts map[statusType]int) statusType {
+	var total int
+	for _, t := range severity {
+		total += counts[t]
+	}
+	errs := counts[StatusError]
+	if errs > 0 && errs*100 >= a.percent*total {
+		return StatusError
+	}
+	if errs > 0 {
+		return StatusUnstable
+	}
+	return mixedAggregator{}.Aggregate(counts)
+}
+
+// idleStatus returns status when there are no ok, unstable or error statuses.
+func idleStatus(counts map[statusType]int) statusType {
+	switch {
+	case counts[StatusRunning] > 0:
+		return StatusRunning
+	case counts[StatusUnknown] > 0:
+		return StatusUnknown
+	case counts[StatusDisabled] > 0:
+		return StatusDisabled
+	}
+	return StatusOK
+}
@@ -0,0 +1,46 @@
+package statuslight
+
+import "testing"
+
+func TestAggregators(t *testing.T) {
+	tests := []struct {
+		policy   string
+		counts   map[statusType]int
+		expected statusType
+	}{
+		{"mixed", map[statusType]int{}, StatusOK},
+		{"mixed", map[statusType]int{StatusOK: 3}, StatusOK},
+		{"mixed", map[statusType]int{StatusOK: 3, StatusError: 1}, StatusUnstable},
+		{"mixed", map[statusType]int{StatusError: 2}, StatusError},
+		{"mixed", map[statusType]int{StatusRunning: 1, StatusDisabled: 1}, StatusRunning},
+		{"mixed", map[statusType]int{StatusDisabled: 2}, StatusDisabled},
+		{"worst", map[statusType]int{StatusOK: 9, StatusError: 1}, StatusError},
+		{"worst", map[statusType]int{StatusOK: 9, StatusRunning: 1}, StatusRunning},
+		{"best", map[statusType]int{StatusOK: 1, StatusError: 9}, StatusOK},
+		{"best", map[statusType]int{StatusUnstable: 1, StatusError: 9}, StatusUnstable},
+		{"majority", map[statusType]int{StatusOK: 2, StatusError: 1}, StatusOK},
+		{"majority", map[statusType]int{StatusOK: 2, StatusError: 2}, StatusError},
+		{"threshold", map[statusType]int{StatusOK: 3, StatusError: 1}, StatusUnstable},
+		{"threshold", map[statusType]int{StatusOK: 1, StatusError: 1}, StatusError},
+		{"threshold", map[statusType]int{StatusOK: 1, StatusRunning: 1}, StatusOK},
+	}
+	for _, test := range tests {
+		aggregator, err := NewAggregator(test.policy, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sts := aggregator.Aggregate(test.counts)
+		if sts != test.expected {
+			t.Errorf("%s %v: expected %s, got %s", test.policy, test.counts, test.expected, sts)
+		}
+	}
+}
+
+func TestNewAggregatorErrors(t *testing.T) {
+	if _, err := NewAggregator("unknown", 50); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+	if _, err := NewAggregator("threshold", 101); err == nil {
+		t.Error("expected error for threshold out of range")
+	}
+}
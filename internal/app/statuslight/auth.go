@@ -0,0 +1,183 @@
+package statuslight
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Scope defines what API token allows, every scope includes lower scopes.
+type Scope int
+
+const (
+	// ScopeRead allows reading statuses and lights.
+	ScopeRead Scope = iota + 1
+	// ScopeWrite allows setting, snoozing and deleting statuses.
+	ScopeWrite
+	// ScopeAdmin allows deleting all statuses.
+	ScopeAdmin
+)
+
+// scopeNames stores names of the scopes used by the token file.
+var scopeNames = map[string]Scope{
+	"read":  ScopeRead,
+	"write": ScopeWrite,
+	"admin": ScopeAdmin,
+}
+
+// token stores API token permissions.
+type token struct {
+	scope Scope
+	// prefix limits token to statuses with identifiers starting with prefix, empty prefix allows all statuses.
+	prefix string
+}
+
+// permits returns true if token allows access to the status with the specified identifier.
+// Nil token allows everything, it is used when authentication is disabled.
+func (t *token) permits(id string) bool {
+	return t == nil || strings.HasPrefix(id, t.prefix)
+}
+
+// Tokens stores API tokens.
+type Tokens struct {
+	// tokens are indexed by token hash, so lookup time doesn't depend on the token value.
+	tokens map[[sha256.Size]byte]token
+}
+
+// LoadTokens reads API tokens from the file. Every line of the file defines single token:
+// token value, scope (read, write or admin) and optional status identifier prefix separated by spaces.
+// Empty lines and lines starting with # are skipped.
+func LoadTokens(path string) (*Tokens, error) {
+	tokens := &Tokens{
+		tokens: make(map[[sha256.Size]byte]token),
+	}
+
+	err := readFields(path, func(fields []string) error {
+		t, err := parseToken("token", fields)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256([]byte(fields[0]))
+		if _, ok := tokens.tokens[hash]; ok {
+			return errors.New("duplicated token")
+		}
+		tokens.tokens[hash] = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// parseToken returns permissions defined by the fields: subject, scope and optional prefix.
+func parseToken(subject string, fields []string) (token, error) {
+	if len(fields) < 2 || len(fields) > 3 {
+		return token{}, fmt.Errorf("expected %s, scope and optional prefix", subject)
+	}
+	scope, ok := scopeNames[fields[1]]
+	if !ok {
+		return token{}, fmt.Errorf("unknown scope: %s", fields[1])
+	}
+	t := token{scope: scope}
+	if len(fields) == 3 {
+		t.prefix = fields[2]
+	}
+	return t, nil
+}
+
+// readFields calls fn with space separated fields of every line of the file,
+// empty lines and lines starting with # are skipped. Errors are prefixed with file path and line number.
+func readFields(path string, fn func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = fn(strings.Fields(line)); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// lookup returns permissions of the token value.
+func (t *Tokens) lookup(value string) (*token, bool) {
+	if t == nil {
+		return nil, false
+	}
+	tok, ok := t.tokens[sha256.Sum256([]byte(value))]
+	if !ok {
+		return nil, false
+	}
+	return &tok, true
+}
+
+// tokenKey is the request context key of the request token.
+type tokenKey struct{}
+
+// requestToken returns token of the authorized request, nil means that authentication is disabled.
+func requestToken(r *http.Request) *token {
+	t, _ := r.Context().Value(tokenKey{}).(*token)
+	return t
+}
+
+// bearerToken returns token sent in Authorization header.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
+
+// queryToken returns handler accepting token in access_token query parameter when Authorization header is missing.
+// It is used only by the event stream, because browsers can't set headers of event streams.
+func queryToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t := r.URL.Query().Get("access_token"); t != "" && r.Header.Get("Authorization") == "" {
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+t)
+		}
+		h(w, r)
+	}
+}
+
+// authorize returns handler passing requests with client certificate or token of at least the specified scope,
+// it passes all requests if authentication is disabled. Client certificate not listed in ACL is ignored.
+func (s *HTTPServer) authorize(scope Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tokens == nil && s.clients == nil {
+			h(w, r)
+			return
+		}
+		t, ok := s.clients.lookup(r)
+		if !ok {
+			t, ok = s.tokens.lookup(bearerToken(r))
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="statuslight"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if t.scope < scope {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, t)))
+	}
+}
@@ -0,0 +1,172 @@
+package statuslight
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTokens writes token file to the temporary directory.
+func writeTokens(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "statuslight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "tokens")
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTokens(t *testing.T) {
+	tokens, err := LoadTokens(writeTokens(t, "# comment\n\nreader read\nwriter write jobs/\n  admin admin  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value  string
+		scope  Scope
+		prefix string
+	}{
+		{"reader", ScopeRead, ""},
+		{"writer", ScopeWrite, "jobs/"},
+		{"admin", ScopeAdmin, ""},
+	}
+	for _, tt := range tests {
+		tok, ok := tokens.lookup(tt.value)
+		if !ok {
+			t.Errorf("expected token %s", tt.value)
+			continue
+		}
+		if tok.scope != tt.scope || tok.prefix != tt.prefix {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.value, tt.scope, tt.prefix, tok.scope, tok.prefix)
+		}
+	}
+	if _, ok := tokens.lookup("unknown"); ok {
+		t.Error("unexpected unknown token")
+	}
+
+	for _, content := range []string{"token", "token owner", "token read prefix extra", "token read\ntoken write"} {
+		if _, err = LoadTokens(writeTokens(t, content)); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	tokens, err := LoadTokens(writeTokens(t, "reader read\nwriter write jobs/\nwriter-all write\nadmin admin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusLight, srv := newTestServer(t, func(s *HTTPServer) {
+		s.SetTokens(tokens)
+	})
+
+	for _, id := range []string{"jobs/first", "other"} {
+		if _, err = statusLight.processStatus(StatusV2{ID: id, State: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		code   int
+	}{
+		{"GET", "/healthz", "", "", http.StatusOK},
+		{"GET", "/metrics", "", "", http.StatusOK},
+		{"GET", "/api/v1/status", "", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/status", "invalid", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/status", "reader", "", http.StatusOK},
+		{"GET", "/api/v1/events?access_token=reader", "", "", http.StatusOK},
+		{"GET", "/api/v1/events?access_token=invalid", "", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/status?access_token=reader", "", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/light?access_token=reader", "", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/light", "reader", "", http.StatusOK},
+		{"POST", "/api/v2/status", "reader", `{"statusId":"jobs/first","state":"error"}`, http.StatusForbidden},
+		{"POST", "/api/v2/status?access_token=writer", "", `{"statusId":"jobs/first","state":"error"}`, http.StatusUnauthorized},
+		{"POST", "/api/v2/status", "writer", `{"statusId":"jobs/first","state":"error"}`, http.StatusOK},
+		{"POST", "/api/v2/status", "writer", `{"statusId":"other","state":"error"}`, http.StatusForbidden},
+		{"POST", "/api/v1/status", "writer", `{"statusId":"other","state":false}`, http.StatusForbidden},
+		{"POST", "/api/v1/statuses", "writer", `[{"statusId":"jobs/second","state":"ok"},{"statusId":"other","state":"ok"}]`, http.StatusForbidden},
+		{"GET", "/api/v1/status/other", "writer", "", http.StatusForbidden},
+		{"POST", "/api/v1/status/other/snooze", "writer", `{"duration":60}`, http.StatusForbidden},
+		{"DELETE", "/api/v1/status/other", "writer", "", http.StatusForbidden},
+		{"DELETE", "/api/v1/status?prefix=jobs/", "writer", "", http.StatusOK},
+		{"DELETE", "/api/v1/status?all=true", "writer-all", "", http.StatusForbidden},
+		{"DELETE", "/api/v1/status?all=true", "admin", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp := request(tt.method, tt.path, tt.token, tt.body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s %s with %q: expected %d, got %d", tt.method, tt.path, tt.token, tt.code, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: expected authentication challenge", tt.method, tt.path)
+		}
+	}
+}
+
+func TestAuthorizationPrefixFiltersStatuses(t *testing.T) {
+	tokens, err := LoadTokens(writeTokens(t, "reader read jobs/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusLight, srv := newTestServer(t, func(s *HTTPServer) {
+		s.SetTokens(tokens)
+	})
+
+	for _, id := range []string{"jobs/first", "other"} {
+		if _, err = statusLight.processStatus(StatusV2{ID: id, State: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/api/v1/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer reader")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats []StatusInfo
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].ID != "jobs/first" {
+		t.Errorf("expected only permitted statuses, got %+v", stats)
+	}
+
+	e, ok := permittedEvent(&token{scope: ScopeRead, prefix: "jobs/"}, Event{Type: EventRemove, Data: RemoveEvent{ID: "other"}})
+	if ok {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
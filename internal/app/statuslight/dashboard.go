@@ -0,0 +1,224 @@
+package statuslight
+
+import (
+	"io"
+	"log"
+	"net/http"
+)
+
+// dashboardHandler serves the web dashboard.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := io.WriteString(w, dashboardHTML)
+	if err != nil {
+		log.Printf("dashboardHandler error: %s\n", err)
+	}
+}
+
+// dashboardHTML is the web dashboard, it is built on the JSON API and refreshed by the event stream.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>statuslight</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.4em 0.8em; border-bottom: 1px solid #ddd; }
+.lamp { display: inline-block; width: 1.2em; height: 1.2em; border-radius: 50%; border: 1px solid #888; vertical-align: middle; margin-right: 0.4em; }
+.state { display: inline-block; padding: 0.1em 0.5em; border-radius: 0.3em; color: #fff; }
+.ok { background: #2e7d32; }
+.unstable { background: #f9a825; }
+.error { background: #c62828; }
+.running { background: #1565c0; }
+.unknown { background: #616161; }
+.disabled { background: #9e9e9e; }
+.muted { color: #888; }
+#connection { float: right; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>statuslight <span id="connection" class="muted">connecting</span></h1>
+
+<h2>Lights</h2>
+<table>
+<thead><tr><th>Group</th><th>Status</th><th>Lamp</th><th>Since</th><th>Notes</th></tr></thead>
+<tbody id="lights"></tbody>
+</table>
+
+<h2>Statuses</h2>
+<table>
+<thead><tr><th>Status</th><th>Group</th><th>State</th><th>Age</th><th>Source</th><th></th></tr></thead>
+<tbody id="statuses"></tbody>
+</table>
+
+<script>
+"use strict";
+
+var statuses = [];
+var light = { groups: [] };
+var reloadTimer = null;
+var token = localStorage.getItem("statuslight-token") || "";
+var asking = false;
+var events = null;
+
+function esc(s) {
+	return String(s === undefined || s === null ? "" : s).replace(/[&<>"']/g, function (c) {
+		return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c];
+	});
+}
+
+function duration(ms) {
+	var s = Math.max(0, Math.floor(ms / 1000));
+	if (s < 60) return s + "s";
+	if (s < 3600) return Math.floor(s / 60) + "m";
+	if (s < 86400) return Math.floor(s / 3600) + "h " + Math.floor(s % 3600 / 60) + "m";
+	return Math.floor(s / 86400) + "d " + Math.floor(s % 86400 / 3600) + "h";
+}
+
+// since and until cells are refreshed every second without rendering whole tables
+function since(t) {
+	return '<span class="since" data-time="' + esc(t) + '">' + duration(Date.now() - new Date(t).getTime()) + "</span>";
+}
+
+function until(t) {
+	return '<span class="until" data-time="' + esc(t) + '">' + duration(new Date(t).getTime() - Date.now()) + "</span>";
+}
+
+function tick() {
+	document.querySelectorAll(".since").forEach(function (e) {
+		e.textContent = duration(Date.now() - new Date(e.dataset.time).getTime());
+	});
+	document.querySelectorAll(".until").forEach(function (e) {
+		e.textContent = duration(new Date(e.dataset.time).getTime() - Date.now());
+	});
+}
+
+function stateLabel(state) {
+	return '<span class="state ' + esc(state) + '">' + esc(state) + "</span>";
+}
+
+function statusPath(id) {
+	return "/api/v1/status/" + encodeURIComponent(id);
+}
+
+function render() {
+	var rows = light.groups.map(function (g) {
+		var lamp = g.sequence ? "sequence " + esc(g.sequence) : esc(g.color || "");
+		var swatch = g.color && g.color !== "off" ? '<span class="lamp" style="background:' + esc(g.color) + '"></span>' : '<span class="lamp"></span>';
+		var notes = [];
+		if (g.quiet) notes.push("quiet");
+		if (g.stale) notes.push("stale");
+		if (g.level > 0) notes.push("escalation " + g.level);
+		if (!g.synced) notes.push("not synced" + (g.error ? ": " + g.error : ""));
+		return "<tr><td>" + esc(g.group) + "</td><td>" + stateLabel(g.status) + "</td><td>" + swatch + lamp +
+			"</td><td>" + (g.since ? since(g.since) : "") + '</td><td class="muted">' + esc(notes.join(", ")) + "</td></tr>";
+	});
+	document.getElementById("lights").innerHTML = rows.join("");
+
+	rows = statuses.map(function (s) {
+		var state = stateLabel(s.state);
+		if (s.snoozedUntil) {
+			state += ' <span class="muted">snoozed for ' + until(s.snoozedUntil) + "</span>";
+		}
+		return "<tr><td>" + esc(s.statusId) + "</td><td>" + esc(s.group) + "</td><td>" + state + "</td><td>" + since(s.updated) +
+			"</td><td>" + esc(s.source) + "</td><td>" +
+			'<select data-id="' + esc(s.statusId) + '" class="snooze">' +
+			'<option value="">snooze</option><option value="900">15 minutes</option><option value="3600">1 hour</option>' +
+			'<option value="14400">4 hours</option><option value="86400">1 day</option><option value="0">wake up</option></select> ' +
+			'<button data-id="' + esc(s.statusId) + '" class="delete">delete</button></td></tr>';
+	});
+	document.getElementById("statuses").innerHTML = rows.length ? rows.join("") : '<tr><td colspan="6" class="muted">no statuses</td></tr>';
+}
+
+// api sends request with API token, it asks for the token when the request is unauthorized
+function api(path, opts) {
+	opts = opts || {};
+	opts.headers = opts.headers || {};
+	if (token) opts.headers["Authorization"] = "Bearer " + token;
+	return fetch(path, opts).then(function (r) {
+		if (r.status === 401) {
+			askToken();
+			throw new Error("unauthorized");
+		}
+		if (r.status === 403) alert("Token doesn't permit this action.");
+		return r;
+	});
+}
+
+function askToken() {
+	if (asking) return;
+	asking = true;
+	var t = prompt("API token");
+	asking = false;
+	if (t === null) return;
+	token = t.trim();
+	localStorage.setItem("statuslight-token", token);
+	connect();
+	reload();
+}
+
+function reload() {
+	Promise.all([api("/api/v1/status"), api("/api/v1/light")]).then(function (resp) {
+		return Promise.all(resp.map(function (r) { return r.json(); }));
+	}).then(function (data) {
+		statuses = data[0];
+		light = data[1];
+		render();
+	}).catch(function () {});
+}
+
+function scheduleReload() {
+	if (reloadTimer === null) {
+		reloadTimer = setTimeout(function () {
+			reloadTimer = null;
+			reload();
+		}, 200);
+	}
+}
+
+document.addEventListener("change", function (e) {
+	if (!e.target.classList.contains("snooze") || e.target.value === "") return;
+	api(statusPath(e.target.dataset.id) + "/snooze", {
+		method: "POST",
+		headers: { "Content-Type": "application/json" },
+		body: JSON.stringify({ duration: parseInt(e.target.value, 10) })
+	}).then(scheduleReload).catch(function () {});
+});
+
+document.addEventListener("click", function (e) {
+	if (!e.target.classList.contains("delete")) return;
+	if (!confirm("Delete status " + e.target.dataset.id + "?")) return;
+	api(statusPath(e.target.dataset.id), { method: "DELETE" }).then(scheduleReload).catch(function () {});
+});
+
+// connect subscribes to the event stream, browsers can't send token header with it, so token is sent in the query
+function connect() {
+	var connection = document.getElementById("connection");
+	if (events) events.close();
+	events = new EventSource("/api/v1/events" + (token ? "?access_token=" + encodeURIComponent(token) : ""));
+	events.addEventListener("open", function () { connection.textContent = "live"; });
+	events.addEventListener("error", function () {
+		connection.textContent = events.readyState === EventSource.CLOSED ? "disconnected" : "reconnecting";
+	});
+	events.addEventListener("snapshot", function (e) {
+		var snapshot = JSON.parse(e.data);
+		statuses = snapshot.statuses;
+		light = snapshot.light;
+		render();
+	});
+	["status", "remove", "aggregate", "light"].forEach(function (type) {
+		events.addEventListener(type, scheduleReload);
+	});
+}
+
+setInterval(tick, 1000);
+connect();
+reload();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,116 @@
+package statuslight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/sgrzywna/milightd/pkg/models"
+)
+
+// ErrUnreachable is wrapped by errors of light drivers unable to connect to the light controller,
+// the command may succeed when it is repeated later.
+var ErrUnreachable = errors.New("light controller unreachable")
+
+// LightDriver represents the light showing the status.
+// Commands return when the context is canceled.
+type LightDriver interface {
+	// SetColor switches the light on with the specified color.
+	SetColor(ctx context.Context, color string) error
+	// SetBrightness sets the light brightness.
+	SetBrightness(ctx context.Context, brightness int) error
+	// RunEffect starts named light effect, e.g. milightd sequence.
+	RunEffect(ctx context.Context, name string) error
+	// Off switches the light off.
+	Off(ctx context.Context) error
+}
+
+// SequenceProvisioner is implemented by light drivers storing sequences in the light controller.
+type SequenceProvisioner interface {
+	// ProvisionSequences creates missing sequences and replaces outdated ones,
+	// it fails if any of required sequences is not defined. Error wraps ErrUnreachable
+	// when the light controller cannot be reached.
+	ProvisionSequences(ctx context.Context, sequences []models.Sequence, required []string) error
+}
+
+// LightSetter is implemented by light drivers setting color and brightness with single command.
+type LightSetter interface {
+	// SetLight switches the light on with the specified color and brightness.
+	SetLight(ctx context.Context, color string, brightness int) error
+}
+
+// setLight switches the light on with the specified color and brightness,
+// drivers implementing LightSetter receive single command.
+func setLight(ctx context.Context, driver LightDriver, color string, brightness int) error {
+	if setter, ok := driver.(LightSetter); ok {
+		return setter.SetLight(ctx, color, brightness)
+	}
+	err := driver.SetColor(ctx, color)
+	if err != nil {
+		return err
+	}
+	return driver.SetBrightness(ctx, brightness)
+}
+
+// Prober is implemented by light drivers able to check that the light controller is reachable.
+type Prober interface {
+	// Probe returns error if the light controller cannot be reached.
+	Probe(ctx context.Context) error
+}
+
+// NewLightDriver returns light driver with the specified name: milightd, log or noop.
+// URL is the address of the light controller, it is used by milightd driver only.
+func NewLightDriver(name, url string) (LightDriver, error) {
+	switch name {
+	case "", "milightd":
+		return newMilightdDriver(url), nil
+	case "log":
+		return logDriver{}, nil
+	case "noop":
+		return noopDriver{}, nil
+	}
+	return nil, fmt.Errorf("unknown light driver: %s", name)
+}
+
+// logDriver only logs light commands, it is useful for dry runs.
+type logDriver struct{}
+
+// SetColor implements LightDriver interface.
+func (logDriver) SetColor(ctx context.Context, color string) error {
+	log.Printf("light color: %s", color)
+	return nil
+}
+
+// SetBrightness implements LightDriver interface.
+func (logDriver) SetBrightness(ctx context.Context, brightness int) error {
+	log.Printf("light brightness: %d", brightness)
+	return nil
+}
+
+// RunEffect implements LightDriver interface.
+func (logDriver) RunEffect(ctx context.Context, name string) error {
+	log.Printf("light effect: %s", name)
+	return nil
+}
+
+// Off implements LightDriver interface.
+func (logDriver) Off(ctx context.Context) error {
+	log.Printf("light off")
+	return nil
+}
+
+// noopDriver ignores light commands.
+type noopDriver struct{}
+
+// SetColor implements LightDriver interface.
+func (noopDriver) SetColor(ctx context.Context, color string) error { return nil }
+
+// SetBrightness implements LightDriver interface.
+func (noopDriver) SetBrightness(ctx context.Context, brightness int) error { return nil }
+
+// RunEffect implements LightDriver interface.
+func (noopDriver) RunEffect(ctx context.Context, name string) error { return nil }
+
+// Off implements LightDriver interface.
+func (noopDriver) Off(ctx context.Context) error { return nil }
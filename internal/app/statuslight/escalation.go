@@ -0,0 +1,69 @@
+package statuslight
+
+import (
+	"sort"
+	"time"
+)
+
+// EscalationRule changes the light when the group status lasts longer than specified time.
+// Settings of the rule are added to settings of the earlier rules for the same status.
+type EscalationRule struct {
+	// Status is the name of the status: ok, unstable, error, running, unknown, disabled.
+	Status string
+	// After is the time the status has to last before the rule is applied.
+	After time.Duration
+	// Color replaces the status color, empty keeps the color.
+	Color string
+	// Sequence replaces the status sequence, empty keeps the sequence.
+	Sequence string
+	// Brightness replaces the light brightness, 0 keeps the brightness.
+	Brightness int
+}
+
+// escalation stores escalation rules for every status, sorted by time.
+type escalation map[statusType][]EscalationRule
+
+// newEscalation returns escalation for the provided rules.
+func newEscalation(rules []EscalationRule) (escalation, error) {
+	e := make(escalation)
+	for _, r := range rules {
+		t, err := parseStatusType(r.Status)
+		if err != nil {
+			return nil, err
+		}
+		e[t] = append(e[t], r)
+	}
+	for _, rules := range e {
+		sort.SliceStable(rules, func(i, j int) bool {
+			return rules[i].After < rules[j].After
+		})
+	}
+	return e, nil
+}
+
+// level returns number of rules applied to the status lasting for the specified time.
+func (e escalation) level(sts statusType, elapsed time.Duration) int {
+	var level int
+	for _, r := range e[sts] {
+		if elapsed < r.After {
+			break
+		}
+		level++
+	}
+	return level
+}
+
+// apply returns light settings of the status escalated to the specified level.
+func (e escalation) apply(sts statusType, level int, color, sequence string, brightness int) (string, string, int) {
+	for _, r := range e[sts][:level] {
+		if r.Sequence != "" {
+			color, sequence = "", r.Sequence
+		} else if r.Color != "" {
+			color, sequence = r.Color, ""
+		}
+		if r.Brightness > 0 {
+			brightness = r.Brightness
+		}
+	}
+	return color, sequence, brightness
+}
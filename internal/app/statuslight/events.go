@@ -0,0 +1,133 @@
+package statuslight
+
+import (
+	"sync"
+	"time"
+)
+
+// eventBuffer defines how many events can wait for slow subscriber before it is dropped.
+const eventBuffer = 64
+
+// Event types sent to the subscribers.
+const (
+	// EventSnapshot carries the current statuses and lights, it is the first event of every subscription.
+	EventSnapshot = "snapshot"
+	// EventStatus carries accepted status update.
+	EventStatus = "status"
+	// EventRemove carries identifier of deleted or expired status.
+	EventRemove = "remove"
+	// EventAggregate carries transition of the group status.
+	EventAggregate = "aggregate"
+	// EventLight carries command sent to the light.
+	EventLight = "light"
+)
+
+// Event describes change of statuses or lights.
+type Event struct {
+	// Type is one of: snapshot, status, remove, aggregate, light.
+	Type string
+	// Data is the event payload: Snapshot, StatusInfo, RemoveEvent, AggregateEvent or LightEvent.
+	Data interface{}
+}
+
+// Snapshot describes the current statuses and lights.
+type Snapshot struct {
+	Statuses []StatusInfo `json:"statuses"`
+	Light    LightState   `json:"light"`
+}
+
+// RemoveEvent describes removed status.
+type RemoveEvent struct {
+	ID string `json:"statusId"`
+	// Reason is deleted, expired or evicted.
+	Reason string `json:"reason"`
+}
+
+// AggregateEvent describes transition of the group status.
+type AggregateEvent struct {
+	Group  string `json:"group"`
+	Status string `json:"status"`
+	// Previous is the previous group status, it is empty when group status is calculated for the first time.
+	Previous string    `json:"previous,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// LightEvent describes command sent to the light.
+type LightEvent struct {
+	Group string `json:"group"`
+	// Command is one of: light, color, brightness, effect, off.
+	// Value of the light command is the color and the brightness separated by slash, e.g. red/32.
+	Command string `json:"command"`
+	Value   string `json:"value,omitempty"`
+	// Error is the error of the command.
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// eventBus passes events to the subscribers, subscriber not keeping up with the events is dropped.
+// Nil event bus ignores all events.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[chan Event]bool
+	closed bool
+}
+
+// newEventBus returns initialized eventBus object.
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[chan Event]bool),
+	}
+}
+
+// subscribe returns channel receiving events and the function ending subscription.
+// The channel is closed when subscriber is dropped or event bus is closed.
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = true
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subs[ch] {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish passes event to all subscribers.
+func (b *eventBus) publish(typ string, data interface{}) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- Event{Type: typ, Data: data}:
+		default:
+			// subscriber gets fresh snapshot when it subscribes again
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends all subscriptions.
+func (b *eventBus) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,45 @@
+package statuslight
+
+import (
+	"testing"
+)
+
+func TestEventBusDropsSlowSubscriber(t *testing.T) {
+	bus := newEventBus()
+
+	slow, _ := bus.subscribe()
+	fast, cancel := bus.subscribe()
+	defer cancel()
+
+	for i := 0; i < eventBuffer+1; i++ {
+		bus.publish(EventStatus, i)
+		<-fast
+	}
+
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != eventBuffer {
+		t.Errorf("expected %d events, got %d", eventBuffer, n)
+	}
+
+	bus.publish(EventStatus, "next")
+	if e := <-fast; e.Data != "next" {
+		t.Errorf("expected %s, got %v", "next", e.Data)
+	}
+
+	bus.close()
+	if _, ok := <-fast; ok {
+		t.Error("expected closed subscription")
+	}
+	if _, ok := <-mustSubscribe(bus); ok {
+		t.Error("expected closed subscription after bus is closed")
+	}
+}
+
+// mustSubscribe returns channel of the new subscription.
+func mustSubscribe(bus *eventBus) <-chan Event {
+	ch, _ := bus.subscribe()
+	return ch
+}
@@ -0,0 +1,120 @@
+package statuslight
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultGroup is the name of the group receiving statuses sent without group.
+const DefaultGroup = "default"
+
+// GroupConfig stores settings of the light driven by the group of statuses.
+type GroupConfig struct {
+	// Name is the group name used by the API.
+	Name string
+	// Driver is the name of the light driver, empty means milightd.
+	Driver string
+	// URL is the light controller URL, e.g. milightd URL.
+	URL        string
+	Colors     StatusMap
+	Sequences  StatusMap
+	Brightness int
+}
+
+// lightGroup represents light showing single status calculated for the group of statuses.
+type lightGroup struct {
+	name       string
+	driver     LightDriver
+	colors     StatusMap
+	sequences  StatusMap
+	brightness int
+	// current is the current group status, it began at since.
+	current statusType
+	since   time.Time
+	// state is the last light state set by the status loop.
+	state lightState
+	// synced is true when the light shows the state.
+	synced bool
+	// setAt is the time when the status was successfully set.
+	setAt time.Time
+	// backoff is the delay of the next retry of failed light command.
+	backoff time.Duration
+	// retryAt is the time of the next retry of failed light command.
+	retryAt time.Time
+	// updatedAt is the time of the last light update, err is its error.
+	updatedAt time.Time
+	err       error
+	// color or sequence is shown by the light, it is stored when light command succeeds.
+	color    string
+	sequence string
+	// provisioned is true when sequences are provisioned in the light controller,
+	// provisionErr is the error of the last provisioning.
+	provisioned  bool
+	provisionErr error
+}
+
+// lightState describes what the light shows.
+type lightState struct {
+	// status is the status calculated for the group.
+	status statusType
+	// quiet is true when the light is in quiet mode outside of working hours.
+	quiet bool
+	// level is the number of escalation rules applied to the status.
+	level int
+	// stale is true when no status update arrived within watchdog window.
+	stale bool
+}
+
+// newLightGroup returns initialized lightGroup object.
+func newLightGroup(cfg GroupConfig) (*lightGroup, error) {
+	driver, err := NewLightDriver(cfg.Driver, cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &lightGroup{
+		name:       cfg.Name,
+		driver:     driver,
+		colors:     cfg.Colors,
+		sequences:  cfg.Sequences,
+		brightness: cfg.Brightness,
+	}, nil
+}
+
+// show sets light according to provided light state, stale light is set by the caller.
+func (g *lightGroup) show(ctx context.Context, state lightState, schedule *Schedule, esc escalation) error {
+	if state.quiet {
+		err := schedule.setQuiet(ctx, g.driver)
+		if err == nil {
+			g.color, g.sequence = schedule.color(), ""
+		}
+		return err
+	}
+	color, sequence, brightness := esc.apply(state.status, state.level, g.colors[state.status], g.sequences[state.status], g.brightness)
+	return g.set(ctx, color, sequence, brightness)
+}
+
+// set runs the sequence, or sets the light color if there is no sequence.
+func (g *lightGroup) set(ctx context.Context, color, sequence string, brightness int) error {
+	var err error
+	if sequence != "" {
+		color = ""
+		err = g.driver.RunEffect(ctx, sequence)
+		if err == nil && brightness != g.brightness {
+			err = g.driver.SetBrightness(ctx, brightness)
+		}
+	} else {
+		err = g.setLight(ctx, color, brightness)
+	}
+	if err == nil {
+		g.color, g.sequence = color, sequence
+	}
+	return err
+}
+
+// setLight sets light color and brightness, colorOff switches the light off.
+func (g *lightGroup) setLight(ctx context.Context, color string, brightness int) error {
+	if color == colorOff {
+		return g.driver.Off(ctx)
+	}
+	return setLight(ctx, g.driver, color, brightness)
+}
@@ -1,19 +1,44 @@
 package statuslight
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+const (
+	// shutdownTimeout defines how long HTTP server waits for requests in progress on shutdown.
+	shutdownTimeout = 10 * time.Second
+	// probeTimeout defines how long readiness check waits for the light controllers.
+	probeTimeout = 5 * time.Second
+	// keepAlivePeriod defines how often idle event stream is kept alive.
+	keepAlivePeriod = 15 * time.Second
+)
+
 // HTTPServer is a HTTP server processing status light commands.
 type HTTPServer struct {
 	port        int
 	statusLight *StatusLight
+	// tokens authorize API requests, nil disables authentication.
+	tokens *Tokens
+	// verifier checks signatures of status submissions, nil disables signing.
+	verifier *verifier
+	// clients authorize API requests with client certificates, nil disables authorization of certificates.
+	clients *ClientACL
+	// tls serves server certificate, nil disables TLS.
+	tls *serverTLS
+	// shutdown is closed when server shuts down, it ends event streams.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
 // NewHTTPServer returns initialized HTTPServer object.
@@ -21,29 +46,303 @@ func NewHTTPServer(port int, statusLight *StatusLight) *HTTPServer {
 	return &HTTPServer{
 		port:        port,
 		statusLight: statusLight,
+		shutdown:    make(chan struct{}),
 	}
 }
 
-// ListenAndServe starts HTTP server.
-func (s *HTTPServer) ListenAndServe() error {
-	r := mux.NewRouter()
-	v1 := r.PathPrefix("/api/v1/").Subrouter()
+// SetTokens enables authentication of API requests with the provided tokens.
+func (s *HTTPServer) SetTokens(tokens *Tokens) {
+	s.tokens = tokens
+}
 
-	v1.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		statusHandler(w, r, s.statusLight)
-	}).Methods("POST")
+// SetSigningKeys enables signed status submissions with the provided keys,
+// signature timestamp can differ from the current time by up to window.
+func (s *HTTPServer) SetSigningKeys(keys *SigningKeys, window time.Duration) {
+	s.verifier = newVerifier(keys, window)
+}
+
+// SetTLS enables TLS serving with the provided certificate, it fails if certificate or client CAs can't be loaded.
+func (s *HTTPServer) SetTLS(cfg TLSConfig) error {
+	t, err := newServerTLS(cfg)
+	if err != nil {
+		return err
+	}
+	s.tls = t
+	return nil
+}
+
+// ReloadTLS replaces server certificate with the one read from the certificate and key files,
+// connections established later use the new certificate. The current certificate is kept on error.
+func (s *HTTPServer) ReloadTLS() error {
+	if s.tls == nil {
+		return errors.New("tls disabled")
+	}
+	return s.tls.reload()
+}
+
+// SetClientACL enables authorization of API requests with client certificates listed in the ACL,
+// requests with other certificates are authorized with API tokens.
+func (s *HTTPServer) SetClientACL(acl *ClientACL) {
+	s.clients = acl
+}
+
+// ListenAndServe starts HTTP server, it runs until the context is canceled.
+// On cancellation server stops accepting connections and waits for requests in progress.
+func (s *HTTPServer) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return err
+	}
+	return s.serve(ctx, ln)
+}
 
+// serve serves HTTP or HTTPS requests on the listener until the context is canceled.
+func (s *HTTPServer) serve(ctx context.Context, ln net.Listener) error {
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         fmt.Sprintf(":%d", s.port),
+		Handler:      s.handler(),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
+	if s.tls != nil {
+		srv.TLSConfig = s.tls.config()
+	}
+	// event streams are long-lived, so they never end graceful shutdown by themselves
+	srv.RegisterOnShutdown(func() {
+		s.shutdownOnce.Do(func() {
+			close(s.shutdown)
+		})
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		if s.tls != nil {
+			errs <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return srv.Shutdown(shutdownCtx)
+}
+
+// handler returns HTTP API request handler.
+func (s *HTTPServer) handler() http.Handler {
+	r := mux.NewRouter()
+	v1 := r.PathPrefix("/api/v1/").Subrouter()
+
+	v1.HandleFunc("/status", s.authorizeSigned(func(w http.ResponseWriter, r *http.Request) {
+		statusHandler(w, r, s.statusLight)
+	})).Methods("POST")
+
+	v1.HandleFunc("/status", s.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, permittedStatuses(requestToken(r), s.statusLight.Statuses()))
+	})).Methods("GET")
+
+	v1.HandleFunc("/status", s.authorize(ScopeWrite, func(w http.ResponseWriter, r *http.Request) {
+		deleteStatusesHandler(w, r, s.statusLight)
+	})).Methods("DELETE")
+
+	v1.HandleFunc("/status/{id:.+}", s.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		getStatusHandler(w, r, s.statusLight)
+	})).Methods("GET")
+
+	v1.HandleFunc("/status/{id:.+}", s.authorize(ScopeWrite, func(w http.ResponseWriter, r *http.Request) {
+		deleteStatusHandler(w, r, s.statusLight)
+	})).Methods("DELETE")
+
+	v1.HandleFunc("/status/{id:.+}/snooze", s.authorize(ScopeWrite, func(w http.ResponseWriter, r *http.Request) {
+		snoozeHandler(w, r, s.statusLight)
+	})).Methods("POST")
+
+	v1.HandleFunc("/statuses", s.authorizeSigned(func(w http.ResponseWriter, r *http.Request) {
+		statusesHandler(w, r, s.statusLight)
+	})).Methods("POST")
+
+	v1.HandleFunc("/light", s.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.statusLight.LightState())
+	})).Methods("GET")
+
+	v1.HandleFunc("/events", queryToken(s.authorize(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		eventsHandler(w, r, s.statusLight, s.shutdown)
+	}))).Methods("GET")
+
+	v2 := r.PathPrefix("/api/v2/").Subrouter()
+
+	v2.HandleFunc("/status", s.authorizeSigned(func(w http.ResponseWriter, r *http.Request) {
+		statusV2Handler(w, r, s.statusLight)
+	})).Methods("POST")
+
+	r.HandleFunc("/", dashboardHandler).Methods("GET")
+
+	r.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler(w, r, s.statusLight)
+	}).Methods("GET")
+
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, healthResponse{Status: "ok"})
+	}).Methods("GET")
+
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyHandler(w, r, s.statusLight)
+	}).Methods("GET")
+
+	return countRequests(r, s.statusLight.metrics)
+}
+
+// countRequests returns handler recording response codes of the requests.
+func countRequests(h http.Handler, m *metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		m.observeRequest(rec.code)
+	})
+}
+
+// statusRecorder stores response code written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader implements http.ResponseWriter interface.
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the original response writer, it is used by http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// metricsHandler writes status light metrics in Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	statusLight.writeMetrics(w)
+}
+
+// healthResponse is the response to the liveness check.
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+// readyHandler reports readiness, it responds with service unavailable code if statuslight daemon is not ready.
+func readyHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	readiness := statusLight.Readiness(ctx)
+	code := http.StatusOK
+	if !readiness.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSONCode(w, code, readiness)
+}
+
+// eventsHandler streams status light events as Server-Sent Events, the first event is the current snapshot.
+// Stream ends when the client disconnects, the server shuts down, or the client doesn't keep up with the events.
+func eventsHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight, shutdown <-chan struct{}) {
+	rc := http.NewResponseController(w)
+	// event stream outlives server write timeout
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Printf("eventsHandler error: %s\n", err)
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := statusLight.subscribe()
+	defer func() {
+		cancel()
+		// let subscription end
+		for range events {
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(keepAlivePeriod)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shutdown:
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			e, ok = permittedEvent(requestToken(r), e)
+			if !ok {
+				continue
+			}
+			err = writeEvent(w, e)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// permittedStatuses returns statuses permitted by the token.
+func permittedStatuses(t *token, stats []StatusInfo) []StatusInfo {
+	if t == nil {
+		return stats
+	}
+	res := make([]StatusInfo, 0, len(stats))
+	for _, s := range stats {
+		if t.permits(s.ID) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// permittedEvent returns event with statuses permitted by the token,
+// false means that the token doesn't permit the event.
+func permittedEvent(t *token, e Event) (Event, bool) {
+	switch data := e.Data.(type) {
+	case Snapshot:
+		data.Statuses = permittedStatuses(t, data.Statuses)
+		e.Data = data
+	case StatusInfo:
+		return e, t.permits(data.ID)
+	case RemoveEvent:
+		return e, t.permits(data.ID)
+	}
+	return e, true
+}
 
-	return srv.ListenAndServe()
+// writeEvent writes event in Server-Sent Events format with JSON encoded data.
+func writeEvent(w io.Writer, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
 }
 
-// statusHandler processes HTTP API calls.
+// statusHandler processes v1 HTTP API calls.
 func statusHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
 	var s Status
 	if r.Body == nil {
@@ -57,9 +356,225 @@ func statusHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLi
 		return
 	}
 
-	err = statusLight.processStatus(s)
+	processStatus(w, r, s.v2(), statusLight)
+}
+
+// statusV2Handler processes v2 HTTP API calls.
+func statusV2Handler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	var s StatusV2
+	if r.Body == nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	processStatus(w, r, s, statusLight)
+}
+
+// statusesHandler processes batch of v2 statuses, statuses are applied atomically.
+func statusesHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	var ss []StatusV2
+	if r.Body == nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&ss)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	for i := range ss {
+		if !requestToken(r).permits(ss[i].ID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if ss[i].Source == "" {
+			ss[i].Source = r.RemoteAddr
+		}
+	}
+
+	evicted, err := statusLight.processStatuses(ss)
+	if errors.Is(err, errUnknownState) || errors.Is(err, errUnknownGroup) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errTooMuchStatuses) {
+		rejectStatus(w, statusLight)
+		return
+	}
+	if err != nil {
+		log.Printf("processStatuses error: %s\n", err)
+		http.Error(w, "statuslight error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, statusResponse{Evicted: evicted})
+}
+
+// getStatusHandler responds with the status selected by identifier.
+func getStatusHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	id := mux.Vars(r)["id"]
+	if !requestToken(r).permits(id) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	s, ok := statusLight.Status(id)
+	if !ok {
+		http.Error(w, "status not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, s)
+}
+
+// deleteStatusHandler removes the status selected by identifier.
+func deleteStatusHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	id := mux.Vars(r)["id"]
+	if !requestToken(r).permits(id) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !statusLight.DeleteStatus(id) {
+		http.Error(w, "status not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Snooze stores snooze parameters.
+type Snooze struct {
+	// Duration is the snooze duration in seconds, 0 ends snooze.
+	Duration int `json:"duration"`
+}
+
+// snoozeHandler shows the status selected by identifier as disabled for the requested duration.
+func snoozeHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	var sn Snooze
+	if r.Body == nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&sn)
+	if err != nil || sn.Duration < 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if !requestToken(r).permits(id) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	s, ok := statusLight.SnoozeStatus(id, time.Duration(sn.Duration)*time.Second)
+	if !ok {
+		http.Error(w, "status not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, s)
+}
+
+// deleteResponse is the response to the bulk delete API calls.
+type deleteResponse struct {
+	// Deleted stores identifiers of deleted statuses.
+	Deleted []string `json:"deleted"`
+}
+
+// deleteStatusesHandler removes statuses selected by prefix, or all statuses.
+// Either prefix or all=true is required, so all statuses are never removed by accident.
+// Removing all statuses requires admin token without prefix.
+func deleteStatusesHandler(w http.ResponseWriter, r *http.Request, statusLight *StatusLight) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if prefix == "" && query.Get("all") != "true" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	t := requestToken(r)
+	if !t.permits(prefix) || (prefix == "" && t != nil && t.scope < ScopeAdmin) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	writeJSON(w, deleteResponse{Deleted: statusLight.DeleteStatuses(prefix)})
+}
+
+// statusResponse is the response to the status API calls.
+type statusResponse struct {
+	// Evicted stores identifiers of statuses evicted to make room for received statuses.
+	Evicted []string `json:"evicted,omitempty"`
+}
+
+// StoreRejection is the response body of the status rejected because there is no room for new statuses.
+type StoreRejection struct {
+	// Error is always "too_much_statuses".
+	Error string `json:"error"`
+	// Capacity is the maximal number of different statuses.
+	Capacity int `json:"capacity"`
+}
+
+// rejectStatus writes response of the status rejected by the eviction policy.
+func rejectStatus(w http.ResponseWriter, statusLight *StatusLight) {
+	writeJSONCode(w, http.StatusInsufficientStorage, StoreRejection{Error: "too_much_statuses", Capacity: statusLight.store.capacity})
+}
+
+// processStatus passes decoded status to the status light and reports the result.
+// Status without source is attributed to the client address.
+func processStatus(w http.ResponseWriter, r *http.Request, s StatusV2, statusLight *StatusLight) {
+	if !requestToken(r).permits(s.ID) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if s.Source == "" {
+		s.Source = r.RemoteAddr
+	}
+	evicted, err := statusLight.processStatus(s)
+	if err == errUnknownState || err == errUnknownGroup {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err == errTooMuchStatuses {
+		rejectStatus(w, statusLight)
+		return
+	}
 	if err != nil {
 		log.Printf("processStatus error: %s\n", err)
 		http.Error(w, "statuslight error", http.StatusInternalServerError)
+		return
+	}
+
+	var resp statusResponse
+	if evicted != "" {
+		resp.Evicted = append(resp.Evicted, evicted)
+	}
+
+	writeJSON(w, resp)
+}
+
+// writeJSON writes JSON encoded value as the response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONCode(w, http.StatusOK, v)
+}
+
+// writeJSONCode writes JSON encoded value as the response with the specified code.
+func writeJSONCode(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("writeJSON error: %s\n", err)
 	}
 }
@@ -0,0 +1,530 @@
+package statuslight
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	var down int32
+	milightd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Method == "GET" && r.URL.Path == "/api/v1/seqctrl" {
+			w.Write([]byte(`{"name":"","state":"stopped"}`))
+		}
+	}))
+	defer milightd.Close()
+
+	statusLight, err := NewStatusLight(context.Background(), Config{
+		Groups:     []GroupConfig{{Name: DefaultGroup, URL: milightd.URL}},
+		Aggregator: mixedAggregator{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statusLight.Close()
+
+	srv := httptest.NewServer(NewHTTPServer(0, statusLight).handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	ready := func() (int, Readiness) {
+		resp, err := http.Get(srv.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var readiness Readiness
+		if err = json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, readiness
+	}
+
+	code, readiness := ready()
+	if code != http.StatusOK || !readiness.Ready || readiness.Loop != "running" {
+		t.Errorf("expected ready, got %d %+v", code, readiness)
+	}
+	if len(readiness.Groups) != 1 || !readiness.Groups[0].Reachable || readiness.Groups[0].Group != DefaultGroup {
+		t.Errorf("expected reachable group, got %+v", readiness.Groups)
+	}
+
+	atomic.StoreInt32(&down, 1)
+	code, readiness = ready()
+	if code != http.StatusServiceUnavailable || readiness.Ready {
+		t.Errorf("expected not ready, got %d %+v", code, readiness)
+	}
+	if len(readiness.Groups) != 1 || readiness.Groups[0].Reachable || readiness.Groups[0].ProbeError == "" {
+		t.Errorf("expected unreachable group, got %+v", readiness.Groups)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	statusLight.Close()
+	code, readiness = ready()
+	if code != http.StatusServiceUnavailable || readiness.Loop != "stopped" {
+		t.Errorf("expected stopped loop, got %d %+v", code, readiness)
+	}
+}
+
+func TestStatusRead(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+
+	for _, body := range []string{
+		`{"statusId":"folder/job","state":"error","ttl":60,"source":"jenkins"}`,
+		`{"statusId":"build","state":"ok"}`,
+	} {
+		resp, err := http.Post(srv.URL+"/api/v2/status", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(srv.URL + "/api/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats []StatusInfo
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].ID != "build" || stats[1].ID != "folder/job" {
+		t.Fatalf("unexpected statuses: %+v", stats)
+	}
+	if stats[0].State != "ok" || stats[0].Expires != nil || !strings.HasPrefix(stats[0].Source, "127.0.0.1:") {
+		t.Errorf("unexpected status: %+v", stats[0])
+	}
+
+	resp, err = http.Get(srv.URL + "/api/v1/status/" + url.PathEscape("folder/job"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s StatusInfo
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != "folder/job" || s.State != "error" || s.Group != DefaultGroup || s.Source != "jenkins" || s.Expires == nil || s.Updated.IsZero() {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/v1/status/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestStatusDelete(t *testing.T) {
+	statusLight, srv := newTestServer(t, nil)
+
+	for id, state := range map[string]string{"build/a": "error", "build/b": "ok", "deploy": "unstable", "test": "ok"} {
+		if _, err := statusLight.processStatus(StatusV2{ID: id, State: state}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	del := func(path string) *http.Response {
+		req, err := http.NewRequest("DELETE", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := del("/api/v1/status/deploy")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp = del("/api/v1/status/deploy")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	resp = del("/api/v1/status?prefix=build/")
+	var deleted deleteResponse
+	err := json.NewDecoder(resp.Body).Decode(&deleted)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(deleted.Deleted) != fmt.Sprint([]string{"build/a", "build/b"}) {
+		t.Errorf("unexpected deleted statuses: %v", deleted.Deleted)
+	}
+	// aggregate is recalculated without deleted statuses
+	if sts := statusLight.getStatus(DefaultGroup, time.Now()); sts != StatusOK {
+		t.Errorf("expected %s, got %s", StatusOK, sts)
+	}
+
+	// reset requires explicit request
+	resp = del("/api/v1/status")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if len(statusLight.Statuses()) != 1 {
+		t.Errorf("expected %d statuses, got %v", 1, statusLight.Statuses())
+	}
+
+	resp = del("/api/v1/status?all=true")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if len(statusLight.Statuses()) != 0 {
+		t.Errorf("expected no statuses, got %v", statusLight.Statuses())
+	}
+}
+
+func TestStatusSubmission(t *testing.T) {
+	statusLight, srv := newTestServer(t, nil)
+
+	tests := []struct {
+		name string
+		id   string
+		path string
+		body string
+		code int
+		// state is the expected state of the status, empty means that status is not stored
+		state string
+	}{
+		{"v1 true", "v1-true", "/api/v1/status", `{"statusId":"v1-true","state":true}`, http.StatusOK, "ok"},
+		{"v1 false", "v1-false", "/api/v1/status", `{"statusId":"v1-false","state":false}`, http.StatusOK, "error"},
+		{"v1 unknown group", "v1-group", "/api/v1/status", `{"statusId":"v1-group","state":true,"group":"missing"}`, http.StatusBadRequest, ""},
+		{"v1 enumerated state", "v1-state", "/api/v1/status", `{"statusId":"v1-state","state":"ok"}`, http.StatusBadRequest, ""},
+		{"v1 invalid json", "", "/api/v1/status", `{"statusId":`, http.StatusBadRequest, ""},
+		{"v2 ok", "v2-ok", "/api/v2/status", `{"statusId":"v2-ok","state":"ok"}`, http.StatusOK, "ok"},
+		{"v2 unstable", "v2-unstable", "/api/v2/status", `{"statusId":"v2-unstable","state":"unstable"}`, http.StatusOK, "unstable"},
+		{"v2 running", "v2-running", "/api/v2/status", `{"statusId":"v2-running","state":"running"}`, http.StatusOK, "running"},
+		{"v2 disabled", "v2-disabled", "/api/v2/status", `{"statusId":"v2-disabled","state":"disabled"}`, http.StatusOK, "disabled"},
+		{"v2 unknown state", "v2-state", "/api/v2/status", `{"statusId":"v2-state","state":"green"}`, http.StatusBadRequest, ""},
+		{"v2 boolean state", "v2-bool", "/api/v2/status", `{"statusId":"v2-bool","state":true}`, http.StatusBadRequest, ""},
+		{"v2 unknown group", "v2-group", "/api/v2/status", `{"statusId":"v2-group","state":"ok","group":"missing"}`, http.StatusBadRequest, ""},
+		{"v2 default group", "v2-default", "/api/v2/status", `{"statusId":"v2-default","state":"error","group":"default"}`, http.StatusOK, "error"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(srv.URL+tt.path, "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, resp.StatusCode)
+		}
+		info, ok := statusLight.Status(tt.id)
+		if tt.state == "" {
+			if ok {
+				t.Errorf("%s: unexpected status %+v", tt.name, info)
+			}
+			continue
+		}
+		if !ok || info.State != tt.state || info.Group != DefaultGroup {
+			t.Errorf("%s: expected %s status in default group, got %+v", tt.name, tt.state, info)
+		}
+	}
+}
+
+func TestStatusBatch(t *testing.T) {
+	statusLight, srv := newTestServer(t, nil)
+
+	post := func(body string) int {
+		resp, err := http.Post(srv.URL+"/api/v1/statuses", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// invalid status rejects whole batch
+	code := post(`[{"statusId":"a","state":"ok"},{"statusId":"b","state":"invalid"}]`)
+	if code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, code)
+	}
+	if len(statusLight.Statuses()) != 0 {
+		t.Errorf("expected no statuses, got %v", statusLight.Statuses())
+	}
+
+	code = post(`[{"statusId":"a","state":"ok"},{"statusId":"b","state":"error","source":"jenkins"}]`)
+	if code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, code)
+	}
+	stats := statusLight.Statuses()
+	if len(stats) != 2 || stats[1].State != "error" || stats[1].Source != "jenkins" || !stats[0].Updated.Equal(stats[1].Updated) {
+		t.Errorf("unexpected statuses: %+v", stats)
+	}
+}
+
+func TestStatusSubmissionTooMuchStatuses(t *testing.T) {
+	statusLight, srv := newTestServer(t, nil)
+
+	for i := 0; i < maxStatuses; i++ {
+		if _, err := statusLight.processStatus(StatusV2{ID: fmt.Sprintf("job-%d", i), State: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		path string
+		body string
+	}{
+		{"/api/v1/status", `{"statusId":"job","status":true}`},
+		{"/api/v2/status", `{"statusId":"job","state":"ok"}`},
+		{"/api/v1/statuses", `[{"statusId":"job-0","state":"error"},{"statusId":"job","state":"ok"}]`},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Post(srv.URL+tt.path, "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rejection StoreRejection
+		err = json.NewDecoder(resp.Body).Decode(&rejection)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInsufficientStorage {
+			t.Errorf("%s: expected %d, got %d", tt.path, http.StatusInsufficientStorage, resp.StatusCode)
+		}
+		if err != nil || rejection.Error != "too_much_statuses" || rejection.Capacity != maxStatuses {
+			t.Errorf("%s: unexpected rejection: %+v, %v", tt.path, rejection, err)
+		}
+	}
+
+	if s, _ := statusLight.Status("job-0"); s.State != "ok" {
+		t.Errorf("expected rejected batch not applied, got %s", s.State)
+	}
+}
+
+// sseEvent is the event read from Server-Sent Events stream.
+type sseEvent struct {
+	typ  string
+	data string
+}
+
+// readEvents reads events from Server-Sent Events stream until it ends.
+func readEvents(r io.Reader, events chan<- sseEvent) {
+	defer close(events)
+	var e sseEvent
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if e.typ != "" {
+				events <- e
+			}
+			e = sseEvent{}
+		case strings.HasPrefix(line, "event: "):
+			e.typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	statusLight, srv := newTestServer(t, nil)
+
+	if _, err := statusLight.processStatus(StatusV2{ID: "first", State: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	// wait until the light shows the first status, so aggregate event is caused by the second one
+	deadline := time.Now().Add(time.Second)
+	for {
+		groups := statusLight.LightState().Groups
+		if len(groups) == 1 && groups[0].Status == "ok" && groups[0].Synced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first status not shown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected %s, got %s", "text/event-stream", ct)
+	}
+
+	events := make(chan sseEvent, 100)
+	go readEvents(resp.Body, events)
+
+	next := func(typ string) sseEvent {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					t.Fatalf("stream ended before %s event", typ)
+				}
+				if e.typ == typ {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("no %s event", typ)
+			}
+		}
+	}
+
+	var snapshot Snapshot
+	if err = json.Unmarshal([]byte(next(EventSnapshot).data), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Statuses) != 1 || snapshot.Statuses[0].ID != "first" {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+
+	if _, err = statusLight.processStatus(StatusV2{ID: "second", State: "error"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var status StatusInfo
+	if err = json.Unmarshal([]byte(next(EventStatus).data), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != "second" || status.State != "error" {
+		t.Errorf("unexpected status event: %+v", status)
+	}
+
+	var aggregate AggregateEvent
+	if err = json.Unmarshal([]byte(next(EventAggregate).data), &aggregate); err != nil {
+		t.Fatal(err)
+	}
+	if aggregate.Group != DefaultGroup || aggregate.Status != "unstable" || aggregate.Previous != "ok" {
+		t.Errorf("unexpected aggregate event: %+v", aggregate)
+	}
+
+	var light LightEvent
+	if err = json.Unmarshal([]byte(next(EventLight).data), &light); err != nil {
+		t.Fatal(err)
+	}
+	if light.Group != DefaultGroup || light.Command != "light" || light.Value != "yellow/32" {
+		t.Errorf("unexpected light event: %+v", light)
+	}
+
+	// stream ends with status loop
+	statusLight.Close()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("stream not ended")
+		}
+	}
+}
+
+func TestStatusSnooze(t *testing.T) {
+	statusLight, srv := newTestServer(t, nil)
+
+	for id, state := range map[string]string{"folder/job": "error", "build": "ok"} {
+		if _, err := statusLight.processStatus(StatusV2{ID: id, State: state}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snooze := func(id, body string) (int, StatusInfo) {
+		resp, err := http.Post(srv.URL+"/api/v1/status/"+url.PathEscape(id)+"/snooze", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var s StatusInfo
+		if resp.StatusCode == http.StatusOK {
+			if err = json.NewDecoder(resp.Body).Decode(&s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, s
+	}
+
+	code, s := snooze("folder/job", `{"duration":3600}`)
+	if code != http.StatusOK || s.ID != "folder/job" || s.State != "error" || s.SnoozedUntil == nil {
+		t.Fatalf("unexpected snooze response: %d %+v", code, s)
+	}
+	// snoozed status is disabled
+	if sts := statusLight.getStatus(DefaultGroup, time.Now()); sts != StatusOK {
+		t.Errorf("expected %s, got %s", StatusOK, sts)
+	}
+	// snooze outlasts status updates
+	if _, err := statusLight.processStatus(StatusV2{ID: "folder/job", State: "error"}); err != nil {
+		t.Fatal(err)
+	}
+	if sts := statusLight.getStatus(DefaultGroup, time.Now()); sts != StatusOK {
+		t.Errorf("expected %s, got %s", StatusOK, sts)
+	}
+
+	code, s = snooze("folder/job", `{"duration":0}`)
+	if code != http.StatusOK || s.SnoozedUntil != nil {
+		t.Errorf("unexpected wake up response: %d %+v", code, s)
+	}
+	if sts := statusLight.getStatus(DefaultGroup, time.Now()); sts != StatusUnstable {
+		t.Errorf("expected %s, got %s", StatusUnstable, sts)
+	}
+
+	if code, _ = snooze("unknown", `{"duration":60}`); code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, code)
+	}
+	if code, _ = snooze("build", `{"duration":-1}`); code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), "/api/v1/events") {
+		t.Error("expected dashboard subscribed to events")
+	}
+}
@@ -0,0 +1,302 @@
+package statuslight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sgrzywna/milightd/pkg/models"
+)
+
+// metrics collects statuslight daemon metrics exposed in Prometheus text format.
+// Nil metrics ignore all observations.
+type metrics struct {
+	mu sync.Mutex
+	// calls stores light driver call statistics.
+	calls map[driverCall]*callStats
+	// requests stores number of HTTP requests by response code.
+	requests map[int]int
+	// lastSet is the time of the last successful light update.
+	lastSet time.Time
+}
+
+// driverCall identifies light driver call of the group.
+type driverCall struct {
+	group string
+	call  string
+}
+
+// callStats stores light driver call statistics.
+type callStats struct {
+	count    int
+	errors   int
+	duration time.Duration
+}
+
+// newMetrics returns initialized metrics object.
+func newMetrics() *metrics {
+	return &metrics{
+		calls:    make(map[driverCall]*callStats),
+		requests: make(map[int]int),
+	}
+}
+
+// observeCall records light driver call.
+func (m *metrics) observeCall(group, call string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := driverCall{group: group, call: call}
+	stats, ok := m.calls[key]
+	if !ok {
+		stats = &callStats{}
+		m.calls[key] = stats
+	}
+	stats.count++
+	stats.duration += duration
+	if err != nil {
+		stats.errors++
+	}
+}
+
+// observeRequest records HTTP request with the response code.
+func (m *metrics) observeRequest(code int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[code]++
+}
+
+// observeSet records successful light update.
+func (m *metrics) observeSet(now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSet = now
+}
+
+// instrumentedDriver is the light driver recording calls of the wrapped driver.
+// Light commands are published as light events.
+type instrumentedDriver struct {
+	driver  LightDriver
+	group   string
+	metrics *metrics
+	events  *eventBus
+}
+
+// observe runs light driver call and records it.
+func (d *instrumentedDriver) observe(call string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	d.metrics.observeCall(d.group, call, time.Since(start), err)
+	return err
+}
+
+// command runs light command, records it and publishes it.
+func (d *instrumentedDriver) command(command, value string, fn func() error) error {
+	err := d.observe(command, fn)
+	d.events.publish(EventLight, LightEvent{
+		Group:   d.group,
+		Command: command,
+		Value:   value,
+		Error:   errorString(err),
+		Time:    time.Now(),
+	})
+	return err
+}
+
+// SetColor implements LightDriver interface.
+func (d *instrumentedDriver) SetColor(ctx context.Context, color string) error {
+	return d.command("color", color, func() error {
+		return d.driver.SetColor(ctx, color)
+	})
+}
+
+// SetBrightness implements LightDriver interface.
+func (d *instrumentedDriver) SetBrightness(ctx context.Context, brightness int) error {
+	return d.command("brightness", strconv.Itoa(brightness), func() error {
+		return d.driver.SetBrightness(ctx, brightness)
+	})
+}
+
+// SetLight implements LightSetter interface, color and brightness are set separately
+// if the wrapped driver doesn't implement it.
+func (d *instrumentedDriver) SetLight(ctx context.Context, color string, brightness int) error {
+	setter, ok := d.driver.(LightSetter)
+	if !ok {
+		err := d.SetColor(ctx, color)
+		if err != nil {
+			return err
+		}
+		return d.SetBrightness(ctx, brightness)
+	}
+	return d.command("light", color+"/"+strconv.Itoa(brightness), func() error {
+		return setter.SetLight(ctx, color, brightness)
+	})
+}
+
+// RunEffect implements LightDriver interface.
+func (d *instrumentedDriver) RunEffect(ctx context.Context, name string) error {
+	return d.command("effect", name, func() error {
+		return d.driver.RunEffect(ctx, name)
+	})
+}
+
+// Off implements LightDriver interface.
+func (d *instrumentedDriver) Off(ctx context.Context) error {
+	return d.command("off", "", func() error {
+		return d.driver.Off(ctx)
+	})
+}
+
+// Probe implements Prober interface, drivers without probe are always reachable.
+func (d *instrumentedDriver) Probe(ctx context.Context) error {
+	prober, ok := d.driver.(Prober)
+	if !ok {
+		return nil
+	}
+	return d.observe("probe", func() error {
+		return prober.Probe(ctx)
+	})
+}
+
+// ProvisionSequences implements SequenceProvisioner interface, drivers without sequences need no provisioning.
+func (d *instrumentedDriver) ProvisionSequences(ctx context.Context, sequences []models.Sequence, required []string) error {
+	provisioner, ok := d.driver.(SequenceProvisioner)
+	if !ok {
+		return nil
+	}
+	return d.observe("provision", func() error {
+		return provisioner.ProvisionSequences(ctx, sequences, required)
+	})
+}
+
+// writeMetrics writes status light metrics in Prometheus text format.
+func (c *StatusLight) writeMetrics(w io.Writer) {
+	now := time.Now()
+	stats := c.store.snapshot()
+
+	counts := make(map[string]map[statusType]int)
+	for _, g := range c.groups {
+		counts[g.name] = make(map[statusType]int)
+	}
+	for _, e := range stats {
+		if e.expired(now) {
+			continue
+		}
+		if counts[e.group] == nil {
+			counts[e.group] = make(map[statusType]int)
+		}
+		counts[e.group][e.effective(now)]++
+	}
+
+	fmt.Fprintln(w, "# HELP statuslight_statuses Number of known status identifiers.")
+	fmt.Fprintln(w, "# TYPE statuslight_statuses gauge")
+	fmt.Fprintf(w, "statuslight_statuses %d\n", len(stats))
+
+	fmt.Fprintln(w, "# HELP statuslight_group_statuses Number of not expired statuses of the group by state, snoozed statuses are disabled.")
+	fmt.Fprintln(w, "# TYPE statuslight_group_statuses gauge")
+	for _, group := range sortedKeys(counts) {
+		for t := StatusOK; t <= StatusDisabled; t++ {
+			fmt.Fprintf(w, "statuslight_group_statuses{group=%s,state=%s} %d\n", labelValue(group), labelValue(t.String()), counts[group][t])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP statuslight_group_status Aggregate status of the group: 0 ok, 1 unstable, 2 error, 3 running, 4 unknown, 5 disabled.")
+	fmt.Fprintln(w, "# TYPE statuslight_group_status gauge")
+	for _, g := range c.groups {
+		fmt.Fprintf(w, "statuslight_group_status{group=%s} %d\n", labelValue(g.name), int(c.getStatus(g.name, time.Now())))
+	}
+
+	m := c.metrics
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	calls := make([]driverCall, 0, len(m.calls))
+	for key := range m.calls {
+		calls = append(calls, key)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].group != calls[j].group {
+			return calls[i].group < calls[j].group
+		}
+		return calls[i].call < calls[j].call
+	})
+
+	fmt.Fprintln(w, "# HELP statuslight_driver_calls_total Number of light driver calls.")
+	fmt.Fprintln(w, "# TYPE statuslight_driver_calls_total counter")
+	for _, key := range calls {
+		fmt.Fprintf(w, "statuslight_driver_calls_total{group=%s,call=%s} %d\n", labelValue(key.group), labelValue(key.call), m.calls[key].count)
+	}
+
+	fmt.Fprintln(w, "# HELP statuslight_driver_call_errors_total Number of failed light driver calls.")
+	fmt.Fprintln(w, "# TYPE statuslight_driver_call_errors_total counter")
+	for _, key := range calls {
+		fmt.Fprintf(w, "statuslight_driver_call_errors_total{group=%s,call=%s} %d\n", labelValue(key.group), labelValue(key.call), m.calls[key].errors)
+	}
+
+	fmt.Fprintln(w, "# HELP statuslight_driver_call_duration_seconds Latency of light driver calls.")
+	fmt.Fprintln(w, "# TYPE statuslight_driver_call_duration_seconds summary")
+	for _, key := range calls {
+		labels := fmt.Sprintf("group=%s,call=%s", labelValue(key.group), labelValue(key.call))
+		fmt.Fprintf(w, "statuslight_driver_call_duration_seconds_sum{%s} %s\n", labels, formatFloat(m.calls[key].duration.Seconds()))
+		fmt.Fprintf(w, "statuslight_driver_call_duration_seconds_count{%s} %d\n", labels, m.calls[key].count)
+	}
+
+	codes := make([]int, 0, len(m.requests))
+	for code := range m.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	fmt.Fprintln(w, "# HELP statuslight_http_requests_total Number of HTTP requests by response code.")
+	fmt.Fprintln(w, "# TYPE statuslight_http_requests_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(w, "statuslight_http_requests_total{code=\"%d\"} %d\n", code, m.requests[code])
+	}
+
+	var lastSet float64
+	if !m.lastSet.IsZero() {
+		lastSet = float64(m.lastSet.UnixNano()) / float64(time.Second)
+	}
+	fmt.Fprintln(w, "# HELP statuslight_last_set_status_timestamp_seconds Time of the last successful light update, 0 if the light has not been set.")
+	fmt.Fprintln(w, "# TYPE statuslight_last_set_status_timestamp_seconds gauge")
+	fmt.Fprintf(w, "statuslight_last_set_status_timestamp_seconds %s\n", formatFloat(lastSet))
+}
+
+// labelEscaper escapes characters not allowed in Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns quoted Prometheus label value.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// formatFloat returns Prometheus representation of the sample value.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// sortedKeys returns sorted keys of the group counts.
+func sortedKeys(m map[string]map[statusType]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
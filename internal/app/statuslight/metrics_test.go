@@ -0,0 +1,139 @@
+package statuslight
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseMetrics parses Prometheus text format, it returns sample values by the sample name with labels.
+func parseMetrics(r io.Reader) (map[string]float64, error) {
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				return nil, fmt.Errorf("invalid comment: %s", line)
+			}
+			if fields[1] == "TYPE" {
+				if len(fields) != 4 {
+					return nil, fmt.Errorf("invalid type: %s", line)
+				}
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid sample: %s", line)
+		}
+		name, value := line[:i], line[i+1:]
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample value: %s", line)
+		}
+		metric := name
+		if j := strings.Index(name, "{"); j >= 0 {
+			if !strings.HasSuffix(name, "}") {
+				return nil, fmt.Errorf("invalid labels: %s", line)
+			}
+			metric = name[:j]
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(metric, "_sum"), "_count")
+		if types[metric] == "" && types[base] != "summary" {
+			return nil, fmt.Errorf("sample without type: %s", line)
+		}
+		if _, ok := samples[name]; ok {
+			return nil, fmt.Errorf("duplicated sample: %s", line)
+		}
+		samples[name] = v
+	}
+	return samples, scanner.Err()
+}
+
+func TestMetrics(t *testing.T) {
+	_, srv := newTestServer(t, nil)
+
+	for _, body := range []string{
+		`{"statusId":"job-1","state":"error"}`,
+		`{"statusId":"job-2","state":"ok"}`,
+		`{"statusId":"job-3","state":"invalid"}`,
+	} {
+		resp, err := http.Post(srv.URL+"/api/v2/status", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// every poll of metrics is counted by the next one
+	var samples map[string]float64
+	var polls int
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get(srv.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples, err = parseMetrics(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (samples["statuslight_last_set_status_timestamp_seconds"] > 0 &&
+			samples[`statuslight_group_status{group="default"}`] == float64(StatusUnstable)) || time.Now().After(deadline) {
+			break
+		}
+		polls++
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := map[string]float64{
+		`statuslight_statuses`: 2,
+		`statuslight_group_statuses{group="default",state="error"}`:          1,
+		`statuslight_group_statuses{group="default",state="ok"}`:             1,
+		`statuslight_group_statuses{group="default",state="running"}`:        0,
+		`statuslight_group_status{group="default"}`:                          float64(StatusUnstable),
+		`statuslight_driver_call_errors_total{group="default",call="light"}`: 0,
+		`statuslight_http_requests_total{code="200"}`:                        float64(2 + polls),
+		`statuslight_http_requests_total{code="400"}`:                        1,
+	}
+	for name, v := range expected {
+		got, ok := samples[name]
+		if !ok {
+			t.Errorf("missing sample %s", name)
+			continue
+		}
+		if got != v {
+			t.Errorf("%s: expected %v, got %v", name, v, got)
+		}
+	}
+	// number of light updates depends on timing of the status loop
+	calls := samples[`statuslight_driver_calls_total{group="default",call="light"}`]
+	if calls < 1 {
+		t.Errorf("expected light driver calls, got %v", calls)
+	}
+	if count := samples[`statuslight_driver_call_duration_seconds_count{group="default",call="light"}`]; count != calls {
+		t.Errorf("expected %v light driver call durations, got %v", calls, count)
+	}
+	if last := samples["statuslight_last_set_status_timestamp_seconds"]; last <= 0 {
+		t.Errorf("expected last set status time, got %v", last)
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	if v := labelValue("a\"b\\c\nd"); v != `"a\"b\\c\nd"` {
+		t.Errorf("expected %s, got %s", `"a\"b\\c\nd"`, v)
+	}
+}
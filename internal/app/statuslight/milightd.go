@@ -0,0 +1,170 @@
+package statuslight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+
+	"github.com/sgrzywna/milightd/pkg/milightdclient"
+	"github.com/sgrzywna/milightd/pkg/models"
+)
+
+// milightdDriver controls Mi-Light lamp through milightd daemon.
+type milightdDriver struct {
+	client *milightdclient.Client
+}
+
+// newMilightdDriver returns initialized milightdDriver object.
+func newMilightdDriver(url string) *milightdDriver {
+	return &milightdDriver{
+		client: milightdclient.NewClient(url),
+	}
+}
+
+// SetColor implements LightDriver interface.
+func (d *milightdDriver) SetColor(ctx context.Context, color string) error {
+	var light models.Light
+
+	light.SetColor(color)
+	light.SetSwitch(true)
+
+	return d.setLight(ctx, light)
+}
+
+// SetBrightness implements LightDriver interface.
+func (d *milightdDriver) SetBrightness(ctx context.Context, brightness int) error {
+	var light models.Light
+
+	light.SetBrightness(brightness)
+
+	return d.setLight(ctx, light)
+}
+
+// SetLight implements LightSetter interface, color and brightness are sent in single milightd command.
+func (d *milightdDriver) SetLight(ctx context.Context, color string, brightness int) error {
+	var light models.Light
+
+	light.SetColor(color)
+	light.SetBrightness(brightness)
+	light.SetSwitch(true)
+
+	return d.setLight(ctx, light)
+}
+
+// RunEffect implements LightDriver interface, effect is the name of milightd sequence.
+func (d *milightdDriver) RunEffect(ctx context.Context, name string) error {
+	state := models.SequenceState{
+		Name:  name,
+		State: models.SeqRunning,
+	}
+	return call(ctx, func() error {
+		return d.client.SetSequenceState(state)
+	})
+}
+
+// Off implements LightDriver interface.
+func (d *milightdDriver) Off(ctx context.Context) error {
+	var light models.Light
+
+	light.SetSwitch(false)
+
+	return d.setLight(ctx, light)
+}
+
+// Probe implements Prober interface, it reads state of the running sequence.
+func (d *milightdDriver) Probe(ctx context.Context) error {
+	return call(ctx, func() error {
+		_, err := d.client.GetSequenceState()
+		return err
+	})
+}
+
+// setLight sends light command to milightd.
+func (d *milightdDriver) setLight(ctx context.Context, light models.Light) error {
+	return call(ctx, func() error {
+		return d.client.SetLight(light)
+	})
+}
+
+// call runs milightd client call, it returns when the call is done or the context is canceled.
+// milightd client doesn't support contexts, so canceled call is abandoned and ends with the client timeout.
+// Transport errors wrap ErrUnreachable.
+func call(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	res := make(chan error, 1)
+	go func() {
+		res <- fn()
+	}()
+	select {
+	case err := <-res:
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%w: %s", ErrUnreachable, err)
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ProvisionSequences implements SequenceProvisioner interface.
+func (d *milightdDriver) ProvisionSequences(ctx context.Context, sequences []models.Sequence, required []string) error {
+	var existing []models.Sequence
+	err := call(ctx, func() (err error) {
+		existing, err = d.client.GetSequences()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	defined := make(map[string]bool)
+	for _, seq := range existing {
+		defined[seq.Name] = true
+	}
+
+	for _, seq := range sequences {
+		if defined[seq.Name] {
+			var current *models.Sequence
+			err = call(ctx, func() (err error) {
+				current, err = d.client.GetSequence(seq.Name)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if reflect.DeepEqual(current.Steps, seq.Steps) {
+				continue
+			}
+			log.Printf("replacing outdated milightd sequence %s", seq.Name)
+			err = call(ctx, func() error {
+				return d.client.DeleteSequence(seq.Name)
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			log.Printf("adding milightd sequence %s", seq.Name)
+		}
+		err = call(ctx, func() error {
+			return d.client.AddSequence(seq)
+		})
+		if err != nil {
+			return err
+		}
+		defined[seq.Name] = true
+	}
+
+	for _, name := range required {
+		if !defined[name] {
+			return fmt.Errorf("sequence %s is not defined in milightd", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package statuslight
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sgrzywna/milightd/pkg/models"
+)
+
+func TestMilightdDriver(t *testing.T) {
+	var lights []models.Light
+	var states []models.SequenceState
+
+	milightd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/light":
+			var l models.Light
+			json.NewDecoder(r.Body).Decode(&l)
+			lights = append(lights, l)
+		case "/api/v1/seqctrl":
+			var s models.SequenceState
+			json.NewDecoder(r.Body).Decode(&s)
+			states = append(states, s)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer milightd.Close()
+
+	driver, err := NewLightDriver("milightd", milightd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if err = driver.SetColor(ctx, "red"); err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.SetBrightness(ctx, 64); err != nil {
+		t.Fatal(err)
+	}
+	// color and brightness are sent in single command
+	if err = setLight(ctx, driver, "green", 32); err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.Off(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.RunEffect(ctx, "blink"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"color:red,brightness:nil,switch:on",
+		"color:nil,brightness:64,switch:nil",
+		"color:green,brightness:32,switch:on",
+		"color:nil,brightness:nil,switch:off",
+	}
+	if len(lights) != len(expected) {
+		t.Fatalf("expected %d light commands, got %d", len(expected), len(lights))
+	}
+	for i, l := range lights {
+		if l.String() != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], l.String())
+		}
+	}
+	if len(states) != 1 || states[0].Name != "blink" || states[0].State != models.SeqRunning {
+		t.Errorf("unexpected sequence commands: %v", states)
+	}
+}
+
+func TestNewLightDriverUnknown(t *testing.T) {
+	if _, err := NewLightDriver("unknown", ""); err == nil {
+		t.Error("expected error for unknown driver")
+	}
+}
+
+func TestMilightdDriverCanceled(t *testing.T) {
+	release := make(chan struct{})
+	milightd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer milightd.Close()
+	defer close(release)
+
+	driver, err := NewLightDriver("milightd", milightd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = driver.SetColor(ctx, "red")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled call returned after %s", elapsed)
+	}
+}
+
+// fakeMilightd is milightd sequence API fake, it drops connections while down is set.
+type fakeMilightd struct {
+	mu        sync.Mutex
+	down      bool
+	sequences map[string]models.Sequence
+	added     []string
+	deleted   []string
+}
+
+func (f *fakeMilightd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/sequence/")
+	switch {
+	case r.URL.Path == "/api/v1/light":
+	case r.Method == "GET" && r.URL.Path == "/api/v1/seqctrl":
+		json.NewEncoder(w).Encode(models.SequenceState{})
+	case r.Method == "GET" && r.URL.Path == "/api/v1/sequence":
+		var list []models.Sequence
+		for _, seq := range f.sequences {
+			list = append(list, seq)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "POST" && r.URL.Path == "/api/v1/sequence":
+		var seq models.Sequence
+		json.NewDecoder(r.Body).Decode(&seq)
+		f.sequences[seq.Name] = seq
+		f.added = append(f.added, seq.Name)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET":
+		seq, ok := f.sequences[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(seq)
+	case r.Method == "DELETE":
+		delete(f.sequences, name)
+		f.deleted = append(f.deleted, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// setDown makes the fake unreachable.
+func (f *fakeMilightd) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+// addedSequences returns names of added sequences.
+func (f *fakeMilightd) addedSequences() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.added...)
+}
+
+// newTestSequence returns single step sequence with the specified color.
+func newTestSequence(name, color string) models.Sequence {
+	var light models.Light
+	light.SetColor(color)
+	return models.Sequence{
+		Name:  name,
+		Steps: []models.SequenceStep{{Light: light, Duration: 500}},
+	}
+}
+
+func TestMilightdProvisionSequences(t *testing.T) {
+	fake := &fakeMilightd{
+		sequences: map[string]models.Sequence{
+			"current":  newTestSequence("current", "red"),
+			"outdated": newTestSequence("outdated", "red"),
+			"manual":   newTestSequence("manual", "blue"),
+		},
+	}
+	milightd := httptest.NewServer(fake)
+	defer milightd.Close()
+
+	driver := newMilightdDriver(milightd.URL)
+
+	err := driver.ProvisionSequences(context.Background(), []models.Sequence{
+		newTestSequence("current", "red"),
+		newTestSequence("outdated", "green"),
+		newTestSequence("missing", "green"),
+	}, []string{"current", "manual", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(fake.added) != fmt.Sprint([]string{"outdated", "missing"}) {
+		t.Errorf("unexpected added sequences: %v", fake.added)
+	}
+	if fmt.Sprint(fake.deleted) != fmt.Sprint([]string{"outdated"}) {
+		t.Errorf("unexpected deleted sequences: %v", fake.deleted)
+	}
+	if c := *fake.sequences["outdated"].Steps[0].Light.Color; c != "green" {
+		t.Errorf("expected %s, got %s", "green", c)
+	}
+
+	err = driver.ProvisionSequences(context.Background(), nil, []string{"undefined"})
+	if err == nil || !strings.Contains(err.Error(), "undefined") {
+		t.Errorf("expected undefined sequence error, got %v", err)
+	}
+}
+
+func TestNewStatusLightProvisioning(t *testing.T) {
+	fake := &fakeMilightd{
+		sequences: map[string]models.Sequence{},
+	}
+	milightd := httptest.NewServer(fake)
+	defer milightd.Close()
+
+	aggregator, err := NewAggregator("mixed", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Groups: []GroupConfig{
+			{
+				Name:      DefaultGroup,
+				URL:       milightd.URL,
+				Colors:    StatusMap{StatusOK: "green"},
+				Sequences: StatusMap{StatusError: "blink"},
+			},
+		},
+		Aggregator: aggregator,
+		RetryMax:   50 * time.Millisecond,
+	}
+
+	// sequence missing in reachable milightd is configuration error
+	if _, err = NewStatusLight(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "blink") {
+		t.Errorf("expected undefined sequence error, got %v", err)
+	}
+
+	// provisioning is deferred until milightd is reachable
+	fake.setDown(true)
+	cfg.SequenceDefinitions = []models.Sequence{newTestSequence("blink", "red")}
+	statusLight, err := NewStatusLight(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statusLight.Close()
+
+	// waitReadiness returns readiness of the status light as soon as it is accepted by fn.
+	waitReadiness := func(fn func(r Readiness) bool) Readiness {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			r := statusLight.Readiness(context.Background())
+			if fn(r) || time.Now().After(deadline) {
+				return r
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	r := waitReadiness(func(r Readiness) bool { return r.Groups[0].ProvisionError != "" })
+	if r.Ready || !strings.Contains(r.Groups[0].ProvisionError, ErrUnreachable.Error()) {
+		t.Errorf("expected unreachable light controller, got %+v", r)
+	}
+
+	fake.setDown(false)
+	r = waitReadiness(func(r Readiness) bool { return r.Ready })
+	if !r.Ready || r.Groups[0].ProvisionError != "" || !r.Groups[0].Synced {
+		t.Errorf("expected provisioned light, got %+v", r)
+	}
+	if added := fake.addedSequences(); fmt.Sprint(added) != fmt.Sprint([]string{"blink"}) {
+		t.Errorf("unexpected added sequences: %v", added)
+	}
+}
@@ -0,0 +1,123 @@
+package statuslight
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays stores names of the week days used by the schedule configuration.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule defines working hours, outside of working hours the light is in quiet mode.
+type Schedule struct {
+	location        *time.Location
+	periods         []period
+	quietColor      string
+	quietBrightness int
+}
+
+// period represents working hours on the specified week days.
+// Period ending before its start ends on the next day.
+type period struct {
+	days  map[time.Weekday]bool
+	start time.Duration
+	end   time.Duration
+}
+
+// NewSchedule returns initialized Schedule object without working hours.
+// In quiet mode the light is set to quietColor with quietBrightness, colorOff switches the light off.
+func NewSchedule(timezone, quietColor string, quietBrightness int) (*Schedule, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &Schedule{
+		location:        location,
+		quietColor:      quietColor,
+		quietBrightness: quietBrightness,
+	}, nil
+}
+
+// AddPeriod adds working hours from start to end (HH:MM) on the specified week days (mon, tue, ...).
+func (s *Schedule) AddPeriod(days []string, start, end string) error {
+	p := period{
+		days: make(map[time.Weekday]bool),
+	}
+	for _, day := range days {
+		d, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("unknown week day: %s", day)
+		}
+		p.days[d] = true
+	}
+	var err error
+	if p.start, err = parseClock(start); err != nil {
+		return err
+	}
+	if p.end, err = parseClock(end); err != nil {
+		return err
+	}
+	s.periods = append(s.periods, p)
+	return nil
+}
+
+// quiet returns true if the specified time is outside of working hours.
+func (s *Schedule) quiet(now time.Time) bool {
+	if s == nil || len(s.periods) == 0 {
+		return false
+	}
+	t := now.In(s.location)
+	day := t.Weekday()
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, p := range s.periods {
+		if p.start < p.end {
+			if p.days[day] && clock >= p.start && clock < p.end {
+				return false
+			}
+			continue
+		}
+		// period spanning midnight
+		if p.days[day] && clock >= p.start {
+			return false
+		}
+		if p.days[(day+6)%7] && clock < p.end {
+			return false
+		}
+	}
+	return true
+}
+
+// setQuiet sets the light to quiet mode.
+func (s *Schedule) setQuiet(ctx context.Context, driver LightDriver) error {
+	if s.quietColor == colorOff || s.quietColor == "" {
+		return driver.Off(ctx)
+	}
+	return setLight(ctx, driver, s.quietColor, s.quietBrightness)
+}
+
+// color returns the color of the light in quiet mode.
+func (s *Schedule) color() string {
+	if s.quietColor == "" {
+		return colorOff
+	}
+	return s.quietColor
+}
+
+// parseClock returns time since midnight for the HH:MM string.
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,65 @@
+package statuslight
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleQuiet(t *testing.T) {
+	schedule, err := NewSchedule("UTC", colorOff, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = schedule.AddPeriod([]string{"mon", "tue", "wed", "thu", "fri"}, "08:00", "18:00"); err != nil {
+		t.Fatal(err)
+	}
+	if err = schedule.AddPeriod([]string{"sat"}, "22:00", "02:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		time  string
+		quiet bool
+	}{
+		{"2018-10-01 07:59", true},  // monday
+		{"2018-10-01 08:00", false}, // monday
+		{"2018-10-05 17:59", false}, // friday
+		{"2018-10-05 18:00", true},  // friday
+		{"2018-10-06 12:00", true},  // saturday
+		{"2018-10-06 23:00", false}, // saturday night
+		{"2018-10-07 01:59", false}, // saturday night
+		{"2018-10-07 02:00", true},  // sunday
+	}
+	for _, test := range tests {
+		now, err := time.Parse("2006-01-02 15:04", test.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quiet := schedule.quiet(now); quiet != test.quiet {
+			t.Errorf("%s: expected %t, got %t", test.time, test.quiet, quiet)
+		}
+	}
+}
+
+func TestScheduleErrors(t *testing.T) {
+	if _, err := NewSchedule("Nowhere/Unknown", colorOff, 0); err == nil {
+		t.Error("expected error for unknown time zone")
+	}
+	schedule, err := NewSchedule("UTC", colorOff, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = schedule.AddPeriod([]string{"someday"}, "08:00", "18:00"); err == nil {
+		t.Error("expected error for unknown week day")
+	}
+	if err = schedule.AddPeriod([]string{"mon"}, "8am", "18:00"); err == nil {
+		t.Error("expected error for invalid time")
+	}
+}
+
+func TestNilScheduleNeverQuiet(t *testing.T) {
+	var schedule *Schedule
+	if schedule.quiet(time.Now()) {
+		t.Error("expected no quiet mode without schedule")
+	}
+}
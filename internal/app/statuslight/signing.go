@@ -0,0 +1,208 @@
+package statuslight
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of signed requests.
+const (
+	// SignatureKeyHeader carries identifier of the signing key.
+	SignatureKeyHeader = "X-Statuslight-Key"
+	// SignatureTimestampHeader carries Unix time of signing in seconds.
+	SignatureTimestampHeader = "X-Statuslight-Timestamp"
+	// SignatureNonceHeader carries unique value of every request, it is accepted once per key.
+	SignatureNonceHeader = "X-Statuslight-Nonce"
+	// SignatureHeader carries hex encoded HMAC-SHA256 of the timestamp, the nonce and the body.
+	SignatureHeader = "X-Statuslight-Signature"
+)
+
+const (
+	// maxSignedBody limits size of the signed request body.
+	maxSignedBody = 1 << 20
+	// maxNonce limits length of the nonce.
+	maxNonce = 64
+)
+
+// Reasons of signature rejection.
+const (
+	signatureMissing    = "missing"
+	signatureMalformed  = "malformed"
+	signatureUnknownKey = "unknown_key"
+	signatureExpired    = "expired"
+	signatureInvalid    = "invalid"
+	signatureReplayed   = "replayed"
+)
+
+// SignatureRejection is the response body of the request with rejected signature.
+type SignatureRejection struct {
+	// Error is always "signature_rejected".
+	Error string `json:"error"`
+	// Reason is one of: missing, malformed, unknown_key, expired, invalid, replayed.
+	Reason string `json:"reason"`
+}
+
+// Signature returns hex encoded HMAC-SHA256 of the timestamp, the nonce and the body of the request.
+func Signature(secret []byte, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingKey stores secret of the signing key and permissions of requests signed with it.
+type signingKey struct {
+	secret []byte
+	token  token
+}
+
+// SigningKeys stores keys of signed status submissions.
+type SigningKeys struct {
+	keys map[string]signingKey
+}
+
+// LoadSigningKeys reads signing keys from the file. Every line of the file defines single key:
+// key identifier, secret and optional status identifier prefix separated by spaces.
+// Empty lines and lines starting with # are skipped.
+func LoadSigningKeys(path string) (*SigningKeys, error) {
+	keys := &SigningKeys{
+		keys: make(map[string]signingKey),
+	}
+
+	err := readFields(path, func(fields []string) error {
+		if len(fields) < 2 || len(fields) > 3 {
+			return errors.New("expected key identifier, secret and optional prefix")
+		}
+		if _, ok := keys.keys[fields[0]]; ok {
+			return errors.New("duplicated key identifier")
+		}
+		k := signingKey{
+			secret: []byte(fields[1]),
+			token:  token{scope: ScopeWrite},
+		}
+		if len(fields) == 3 {
+			k.token.prefix = fields[2]
+		}
+		keys.keys[fields[0]] = k
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// verifier checks signatures of status submissions and rejects replayed requests.
+type verifier struct {
+	keys *SigningKeys
+	// window defines how far request timestamp can be from the current time.
+	window time.Duration
+	mu     sync.Mutex
+	// seen stores key identifiers and nonces of accepted requests with their timestamps,
+	// nonces are forgotten when their timestamps are outside of the window.
+	seen map[string]time.Time
+}
+
+// newVerifier returns initialized verifier object.
+func newVerifier(keys *SigningKeys, window time.Duration) *verifier {
+	return &verifier{
+		keys:   keys,
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// verify checks signature of the request with the body, it returns permissions of the signing key
+// or the reason of rejection.
+func (v *verifier) verify(r *http.Request, body []byte, now time.Time) (*token, string) {
+	id := r.Header.Get(SignatureKeyHeader)
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	nonce := r.Header.Get(SignatureNonceHeader)
+	signature := r.Header.Get(SignatureHeader)
+	if id == "" || timestamp == "" || nonce == "" || len(nonce) > maxNonce || signature == "" {
+		return nil, signatureMalformed
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, signatureMalformed
+	}
+	key, ok := v.keys.keys[id]
+	if !ok {
+		return nil, signatureUnknownKey
+	}
+	signed := time.Unix(sec, 0)
+	if signed.Before(now.Add(-v.window)) || signed.After(now.Add(v.window)) {
+		return nil, signatureExpired
+	}
+	if !hmac.Equal([]byte(signature), []byte(Signature(key.secret, timestamp, nonce, body))) {
+		return nil, signatureInvalid
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for n, t := range v.seen {
+		if t.Before(now.Add(-v.window)) {
+			delete(v.seen, n)
+		}
+	}
+	// nonce is unique per key, keys are independent of each other
+	seenKey := id + "\x00" + nonce
+	if _, ok := v.seen[seenKey]; ok {
+		return nil, signatureReplayed
+	}
+	v.seen[seenKey] = signed
+
+	return &key.token, ""
+}
+
+// authorizeSigned returns handler passing status submissions with valid signature,
+// unsigned requests are authorized with client certificate or API token. Unsigned requests are rejected
+// when signing is enabled and authentication with certificates and tokens is disabled.
+func (s *HTTPServer) authorizeSigned(h http.HandlerFunc) http.HandlerFunc {
+	authorized := s.authorize(ScopeWrite, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.verifier == nil {
+			authorized(w, r)
+			return
+		}
+		if r.Header.Get(SignatureHeader) == "" {
+			if s.tokens == nil && s.clients == nil {
+				rejectSignature(w, signatureMissing)
+				return
+			}
+			authorized(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		t, reason := s.verifier.verify(r, body, time.Now())
+		if t == nil {
+			rejectSignature(w, reason)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, t)))
+	}
+}
+
+// rejectSignature writes response of the request with rejected signature.
+func rejectSignature(w http.ResponseWriter, reason string) {
+	w.Header().Set("WWW-Authenticate", `Statuslight-HMAC realm="statuslight"`)
+	writeJSONCode(w, http.StatusUnauthorized, SignatureRejection{Error: "signature_rejected", Reason: reason})
+}
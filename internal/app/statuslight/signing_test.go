@@ -0,0 +1,231 @@
+package statuslight
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest returns request with the body signed with the key, every request gets random nonce.
+func signedRequest(t *testing.T, url, keyID, secret string, signed time.Time, body string) *http.Request {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return signedNonceRequest(t, url, keyID, secret, signed, hex.EncodeToString(b), body)
+}
+
+// signedNonceRequest returns request with the body and the nonce signed with the key.
+func signedNonceRequest(t *testing.T, url, keyID, secret string, signed time.Time, nonce, body string) *http.Request {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(signed.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureKeyHeader, keyID)
+	req.Header.Set(SignatureTimestampHeader, timestamp)
+	req.Header.Set(SignatureNonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Signature([]byte(secret), timestamp, nonce, []byte(body)))
+	return req
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	keys, err := LoadSigningKeys(writeTokens(t, "# comment\nci secret\nnightly other nightly/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := keys.keys["ci"]; string(k.secret) != "secret" || k.token.scope != ScopeWrite || k.token.prefix != "" {
+		t.Errorf("unexpected key %+v", k)
+	}
+	if k := keys.keys["nightly"]; string(k.secret) != "other" || k.token.prefix != "nightly/" {
+		t.Errorf("unexpected key %+v", k)
+	}
+
+	for _, content := range []string{"ci", "ci secret prefix extra", "ci secret\nci other"} {
+		if _, err = LoadSigningKeys(writeTokens(t, content)); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	keys, err := LoadSigningKeys(writeTokens(t, "ci secret\nnightly other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newVerifier(keys, time.Minute)
+	now := time.Now()
+	body := `{"statusId":"first","state":false}`
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		body   string
+		reason string
+	}{
+		{"valid", signedNonceRequest(t, "/", "ci", "secret", now, "1", body), body, ""},
+		{"replayed", signedNonceRequest(t, "/", "ci", "secret", now, "1", body), body, signatureReplayed},
+		{"same body and time", signedNonceRequest(t, "/", "ci", "secret", now, "2", body), body, ""},
+		{"same nonce of other key", signedNonceRequest(t, "/", "nightly", "other", now, "1", body), body, ""},
+		{"missing nonce", signedNonceRequest(t, "/", "ci", "secret", now, "", body), body, signatureMalformed},
+		{"long nonce", signedNonceRequest(t, "/", "ci", "secret", now, strings.Repeat("n", maxNonce+1), body), body, signatureMalformed},
+		{"changed body", signedRequest(t, "/", "ci", "secret", now.Add(time.Second), body), `{"statusId":"first","state":true}`, signatureInvalid},
+		{"wrong secret", signedRequest(t, "/", "ci", "other", now.Add(2*time.Second), body), body, signatureInvalid},
+		{"unknown key", signedRequest(t, "/", "other", "secret", now, body), body, signatureUnknownKey},
+		{"old", signedRequest(t, "/", "ci", "secret", now.Add(-2*time.Minute), body), body, signatureExpired},
+		{"future", signedRequest(t, "/", "ci", "secret", now.Add(2*time.Minute), body), body, signatureExpired},
+	}
+	for _, tt := range tests {
+		tok, reason := v.verify(tt.req, []byte(tt.body), now)
+		if reason != tt.reason {
+			t.Errorf("%s: expected reason %q, got %q", tt.name, tt.reason, reason)
+		}
+		if (tok != nil) != (tt.reason == "") {
+			t.Errorf("%s: unexpected token %+v", tt.name, tok)
+		}
+	}
+
+	req := signedRequest(t, "/", "ci", "secret", now, body)
+	req.Header.Set(SignatureTimestampHeader, "yesterday")
+	if _, reason := v.verify(req, []byte(body), now); reason != signatureMalformed {
+		t.Errorf("expected reason %q, got %q", signatureMalformed, reason)
+	}
+
+	// seen nonces are forgotten when their timestamps leave the window
+	later := now.Add(2 * time.Minute)
+	if _, reason := v.verify(signedNonceRequest(t, "/", "ci", "secret", later, "1", body), []byte(body), later); reason != "" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	if len(v.seen) != 1 {
+		t.Errorf("expected 1 seen nonce, got %d", len(v.seen))
+	}
+}
+
+func TestSignedStatus(t *testing.T) {
+	tokens, err := LoadTokens(writeTokens(t, "writer write\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadSigningKeys(writeTokens(t, "ci secret jobs/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusLight, srv := newTestServer(t, func(s *HTTPServer) {
+		s.SetTokens(tokens)
+		s.SetSigningKeys(keys, time.Minute)
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		secret string
+		code   int
+		reason string
+	}{
+		{"v1", "/api/v1/status", `{"statusId":"jobs/first","state":true}`, "secret", http.StatusOK, ""},
+		{"v2", "/api/v2/status", `{"statusId":"jobs/second","state":"ok"}`, "secret", http.StatusOK, ""},
+		{"batch", "/api/v1/statuses", `[{"statusId":"jobs/third","state":"ok"}]`, "secret", http.StatusOK, ""},
+		{"prefix", "/api/v1/status", `{"statusId":"other","state":true}`, "secret", http.StatusForbidden, ""},
+		{"invalid", "/api/v1/status", `{"statusId":"jobs/fourth","state":true}`, "wrong", http.StatusUnauthorized, signatureInvalid},
+	}
+	for _, tt := range tests {
+		resp, err := http.DefaultClient.Do(signedRequest(t, srv.URL+tt.path, "ci", tt.secret, time.Now(), tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, resp.StatusCode)
+		}
+		if tt.reason != "" {
+			var rejection SignatureRejection
+			if err = json.NewDecoder(resp.Body).Decode(&rejection); err != nil {
+				t.Errorf("%s: %s", tt.name, err)
+			}
+			if rejection.Error != "signature_rejected" || rejection.Reason != tt.reason {
+				t.Errorf("%s: unexpected rejection %+v", tt.name, rejection)
+			}
+		}
+		resp.Body.Close()
+	}
+
+	for _, id := range []string{"jobs/first", "jobs/second", "jobs/third"} {
+		if _, ok := statusLight.Status(id); !ok {
+			t.Errorf("expected status %s", id)
+		}
+	}
+
+	// unsigned submission needs API token
+	resp, err := http.Post(srv.URL+"/api/v1/status", "application/json", bytes.NewBufferString(`{"statusId":"other","state":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestSignedStatusWithoutTokens(t *testing.T) {
+	keys, err := LoadSigningKeys(writeTokens(t, "ci secret jobs/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusLight, srv := newTestServer(t, func(s *HTTPServer) {
+		s.SetSigningKeys(keys, time.Minute)
+	})
+
+	// unsigned submission can't bypass signing when tokens are disabled
+	submissions := map[string]string{
+		"/api/v1/status":   `{"statusId":"other","state":true}`,
+		"/api/v2/status":   `{"statusId":"other","state":"ok"}`,
+		"/api/v1/statuses": `[{"statusId":"other","state":"ok"}]`,
+	}
+	for path, body := range submissions {
+		resp, err := http.Post(srv.URL+path, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rejection SignatureRejection
+		err = json.NewDecoder(resp.Body).Decode(&rejection)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d, got %d", path, http.StatusUnauthorized, resp.StatusCode)
+		}
+		if rejection.Reason != signatureMissing {
+			t.Errorf("%s: expected reason %q, got %q", path, signatureMissing, rejection.Reason)
+		}
+	}
+	if _, ok := statusLight.Status("other"); ok {
+		t.Error("unexpected status other")
+	}
+
+	resp, err := http.DefaultClient.Do(signedRequest(t, srv.URL+"/api/v2/status", "ci", "secret", time.Now(), `{"statusId":"jobs/first","state":"ok"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// reads are not signed and stay open
+	resp, err = http.Get(srv.URL + "/api/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
@@ -0,0 +1,100 @@
+package statuslight
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedStatus stores status in the state file.
+type savedStatus struct {
+	ID      string    `json:"statusId"`
+	State   string    `json:"state"`
+	Group   string    `json:"group"`
+	Source  string    `json:"source,omitempty"`
+	Updated time.Time `json:"updated"`
+	Expires time.Time `json:"expires"`
+	Snoozed time.Time `json:"snoozed"`
+}
+
+// saveState atomically writes statuses to the state file.
+func saveState(path string, stats map[string]statusEntry) error {
+	saved := make([]savedStatus, 0, len(stats))
+	for id, e := range stats {
+		saved = append(saved, savedStatus{
+			ID:      id,
+			State:   e.state.String(),
+			Group:   e.group,
+			Source:  e.source,
+			Updated: e.updated,
+			Expires: e.expires,
+			Snoozed: e.snoozed,
+		})
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// write to the temporary file in the same directory and rename it,
+	// so the state file is never left partially written
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// loadState reads statuses from the state file, missing file gives no statuses.
+func loadState(path string) (map[string]statusEntry, error) {
+	stats := make(map[string]statusEntry)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []savedStatus
+
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range saved {
+		state, err := parseStatusType(s.State)
+		if err != nil {
+			return nil, err
+		}
+		stats[s.ID] = statusEntry{
+			state:   state,
+			group:   s.Group,
+			source:  s.Source,
+			updated: s.Updated,
+			expires: s.Expires,
+			snoozed: s.Snoozed,
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,134 @@
+package statuslight
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statuslight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	updated := time.Now().Round(time.Second)
+
+	err = saveState(path, map[string]statusEntry{
+		"parent/first": {state: StatusError, group: DefaultGroup, source: "jenkins", updated: updated},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := stats["parent/first"]
+	if !ok {
+		t.Fatalf("expected %s status, got %v", "parent/first", stats)
+	}
+	if e.state != StatusError {
+		t.Errorf("expected %s, got %s", StatusError, e.state)
+	}
+	if e.source != "jenkins" {
+		t.Errorf("expected %s, got %s", "jenkins", e.source)
+	}
+	if !e.updated.Equal(updated) {
+		t.Errorf("expected %s, got %s", updated, e.updated)
+	}
+	if !e.expires.IsZero() {
+		t.Errorf("expected no expiration, got %s", e.expires)
+	}
+}
+
+func TestLoadMissingState(t *testing.T) {
+	stats, err := loadState(filepath.Join(os.TempDir(), "statuslight-missing-state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 0 {
+		t.Errorf("expected no statuses, got %v", stats)
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statuslight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	now := time.Now().Round(time.Second)
+
+	err = saveState(path, map[string]statusEntry{
+		"first":   {state: StatusOK, group: DefaultGroup, updated: now.Add(-3 * time.Minute)},
+		"second":  {state: StatusError, group: DefaultGroup, updated: now.Add(-2 * time.Minute)},
+		"third":   {state: StatusUnstable, group: DefaultGroup, updated: now.Add(-time.Minute)},
+		"old":     {state: StatusOK, group: DefaultGroup, updated: now.Add(-2 * time.Hour)},
+		"expired": {state: StatusOK, group: DefaultGroup, updated: now.Add(-time.Minute), expires: now.Add(-30 * time.Second)},
+		"unknown": {state: StatusOK, group: "lobby", updated: now.Add(-time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	milightd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer milightd.Close()
+
+	aggregator, err := NewAggregator("mixed", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name        string
+		maxStatuses int
+		eviction    EvictionPolicy
+		restored    string
+	}{
+		{"all", 0, EvictReject, "first,second,third"},
+		{"lru", 2, EvictLeastRecentlyUpdated, "second,third"},
+		{"reject", 2, EvictReject, "first,second"},
+	}
+
+	for _, tt := range tests {
+		statusLight, err := NewStatusLight(context.Background(), Config{
+			Groups: []GroupConfig{
+				{
+					Name:   DefaultGroup,
+					URL:    milightd.URL,
+					Colors: StatusMap{StatusOK: "green", StatusUnstable: "yellow", StatusError: "red"},
+				},
+			},
+			Aggregator:  aggregator,
+			StateFile:   path,
+			StateMaxAge: time.Hour,
+			MaxStatuses: tt.maxStatuses,
+			Eviction:    tt.eviction,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		var ids []string
+		for _, s := range statusLight.Statuses() {
+			ids = append(ids, s.ID)
+		}
+		statusLight.Close()
+		if restored := strings.Join(ids, ","); restored != tt.restored {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.restored, restored)
+		}
+	}
+}
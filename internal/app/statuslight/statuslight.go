@@ -1,11 +1,14 @@
 package statuslight
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/sgrzywna/milightd/pkg/milightdclient"
 	"github.com/sgrzywna/milightd/pkg/models"
 )
 
@@ -15,6 +18,19 @@ type statusType int
 // StatusMap stores mapping between status and related action.
 type StatusMap map[statusType]string
 
+// NewStatusMap returns StatusMap for the mapping between status names and actions.
+func NewStatusMap(m map[string]string) (StatusMap, error) {
+	res := make(StatusMap)
+	for name, action := range m {
+		t, err := parseStatusType(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, name)
+		}
+		res[t] = action
+	}
+	return res, nil
+}
+
 const (
 	// StatusOK represents OK status.
 	StatusOK statusType = iota
@@ -22,139 +38,969 @@ const (
 	StatusUnstable
 	// StatusError represents error status.
 	StatusError
-	// maxStatuses defines maximal number of different statuses that can be processed by statuslight daemon.
+	// StatusRunning represents status of the job in progress.
+	StatusRunning
+	// StatusUnknown represents status that cannot be determined.
+	StatusUnknown
+	// StatusDisabled represents status of the disabled job.
+	StatusDisabled
+	// maxStatuses defines default maximal number of different statuses that can be processed by statuslight daemon.
 	maxStatuses = 16
-	// setStatusPeriod defines how often statuslight daemon will connect to milightd daemon to set the light.
+	// setStatusPeriod defines how often statuslight daemon re-evaluates the lights for quiet hours, escalation
+	// and stale data, status changes, expirations and snooze ends are shown immediately.
 	setStatusPeriod = 30 * time.Second
+	// minRetryPeriod defines delay of the first retry of failed light command, following delays are doubled.
+	minRetryPeriod = time.Second
+	// offlineTimeout defines how long statuslight daemon tries to set offline light on exit.
+	offlineTimeout = 5 * time.Second
+	// colorOff is the color name that switches the light off.
+	colorOff = "off"
 )
 
 var (
 	// errTooMuchStatuses is returned when statuses queue is full.
 	errTooMuchStatuses = errors.New("too much statuses")
+	// errUnknownState is returned when received status state is not supported.
+	errUnknownState = errors.New("unknown state")
+	// errUnknownGroup is returned when received status refers to not configured group.
+	errUnknownGroup = errors.New("unknown group")
 )
 
-// Status stores status details
+// statusNames stores names of the status types used by the API.
+var statusNames = map[statusType]string{
+	StatusOK:       "ok",
+	StatusUnstable: "unstable",
+	StatusError:    "error",
+	StatusRunning:  "running",
+	StatusUnknown:  "unknown",
+	StatusDisabled: "disabled",
+}
+
+// String implements string representation for the statusType.
+func (t statusType) String() string {
+	if name, ok := statusNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("status(%d)", int(t))
+}
+
+// parseStatusType returns status type for the provided name.
+func parseStatusType(name string) (statusType, error) {
+	for t, n := range statusNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return StatusUnknown, errUnknownState
+}
+
+// Status stores status details, it is the v1 API status with boolean state.
 type Status struct {
 	State bool   `json:"state"`
 	ID    string `json:"statusId"`
+	// TTL is the status time-to-live in seconds, 0 means daemon default.
+	TTL int `json:"ttl,omitempty"`
+	// Group is the name of the status group, empty means default group.
+	Group string `json:"group,omitempty"`
+	// Source identifies the reporter, empty means the address of the client.
+	Source string `json:"source,omitempty"`
+}
+
+// v2 converts v1 status to the v2 status, true maps to ok and false maps to error.
+func (s Status) v2() StatusV2 {
+	state := StatusError
+	if s.State {
+		state = StatusOK
+	}
+	return StatusV2{
+		State:  state.String(),
+		ID:     s.ID,
+		TTL:    s.TTL,
+		Group:  s.Group,
+		Source: s.Source,
+	}
+}
+
+// StatusV2 stores status details, it is the v2 API status with enumerated state.
+type StatusV2 struct {
+	// State is one of: ok, unstable, error, running, unknown, disabled.
+	State string `json:"state"`
+	ID    string `json:"statusId"`
+	// TTL is the status time-to-live in seconds, 0 means daemon default.
+	TTL int `json:"ttl,omitempty"`
+	// Group is the name of the status group, empty means default group.
+	Group string `json:"group,omitempty"`
+	// Source identifies the reporter, empty means the address of the client.
+	Source string `json:"source,omitempty"`
+}
+
+// statusEntry stores received status together with its group, source, update and expiration time.
+type statusEntry struct {
+	state   statusType
+	group   string
+	source  string
+	updated time.Time
+	expires time.Time
+	// snoozed is the time until which status is shown as disabled.
+	snoozed time.Time
+}
+
+// expired returns true if status entry is expired at the specified time.
+func (e statusEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// effective returns status type used to calculate group status at the specified time,
+// snoozed status is disabled.
+func (e statusEntry) effective(now time.Time) statusType {
+	if now.Before(e.snoozed) {
+		return StatusDisabled
+	}
+	return e.state
+}
+
+// info returns API representation of the status entry.
+func (e statusEntry) info(id string) StatusInfo {
+	info := StatusInfo{
+		ID:      id,
+		State:   e.state.String(),
+		Group:   e.group,
+		Source:  e.source,
+		Updated: e.updated,
+	}
+	if !e.expires.IsZero() {
+		expires := e.expires
+		info.Expires = &expires
+	}
+	if time.Now().Before(e.snoozed) {
+		snoozed := e.snoozed
+		info.SnoozedUntil = &snoozed
+	}
+	return info
+}
+
+// StatusInfo describes received status.
+type StatusInfo struct {
+	ID    string `json:"statusId"`
+	State string `json:"state"`
+	Group string `json:"group"`
+	// Source identifies the reporter of the status.
+	Source string `json:"source,omitempty"`
+	// Updated is the time of the last status update.
+	Updated time.Time `json:"updated"`
+	// Expires is the status expiration time, nil means that status doesn't expire.
+	Expires *time.Time `json:"expires,omitempty"`
+	// SnoozedUntil is the time until which status is shown as disabled, nil means that status is not snoozed.
+	SnoozedUntil *time.Time `json:"snoozedUntil,omitempty"`
+}
+
+// Config stores StatusLight configuration.
+type Config struct {
+	// Groups stores settings of the lights, there is a light for every group of statuses.
+	Groups []GroupConfig
+	// TTL is the time-to-live of statuses received without own TTL, 0 disables expiration.
+	TTL time.Duration
+	// Aggregator calculates single status from all statuses of the group.
+	Aggregator Aggregator
+	// StateFile is the path to the file storing statuses across restarts, empty disables persistence.
+	StateFile string
+	// StateMaxAge is the age above which statuses from the state file are dropped, 0 keeps all statuses.
+	StateMaxAge time.Duration
+	// Debounce is the time to collect status changes before the lights are updated.
+	Debounce time.Duration
+	// MinInterval is the minimal interval between consecutive light updates.
+	MinInterval time.Duration
+	// MaxStatuses is the maximal number of different statuses, 0 means default.
+	MaxStatuses int
+	// Eviction defines how new status is stored when there are already MaxStatuses statuses.
+	Eviction EvictionPolicy
+	// RetryMax is the maximal delay between retries of failed light commands, 0 means no limit.
+	RetryMax time.Duration
+	// Reassert is the period of re-sending current status to the light even if it has not changed, 0 disables it.
+	Reassert time.Duration
+	// Schedule defines working hours, nil means that the light always shows the status.
+	Schedule *Schedule
+	// Escalations change the light when the group status lasts long.
+	Escalations []EscalationRule
+	// OfflineColor is the color set on exit, empty leaves the light unchanged.
+	OfflineColor string
+	// OfflineSequence is the sequence run on exit, it takes precedence over OfflineColor.
+	OfflineSequence string
+	// StaleAfter is the time without any status update after which the light shows stale data, 0 disables watchdog.
+	StaleAfter time.Duration
+	// StaleColor is the color showing stale data.
+	StaleColor string
+	// StaleSequence is the sequence showing stale data, it takes precedence over StaleColor.
+	StaleSequence string
+	// SequenceDefinitions are created or updated in the light controller on startup,
+	// or as soon as the light controller becomes reachable.
+	SequenceDefinitions []models.Sequence
+}
+
+// LightState describes state of the lights.
+type LightState struct {
+	// Quiet is true outside of working hours.
+	Quiet bool `json:"quiet"`
+	// Stale is true when no status update arrived within watchdog window.
+	Stale bool `json:"stale"`
+	// LastUpdate is the time of the most recent status update.
+	LastUpdate time.Time    `json:"lastUpdate"`
+	Groups     []GroupLight `json:"groups"`
+}
+
+// GroupLight describes state of the group light.
+type GroupLight struct {
+	Group string `json:"group"`
+	// Status is the status calculated for the group.
+	Status string `json:"status"`
+	// Quiet is true when the light is in quiet mode.
+	Quiet bool `json:"quiet"`
+	// Stale is true when the light shows stale data.
+	Stale bool `json:"stale"`
+	// Since is the time when the status began.
+	Since time.Time `json:"since"`
+	// Level is the number of escalation rules applied to the status.
+	Level int `json:"level"`
+	// Synced is false when the light failed to be set.
+	Synced bool `json:"synced"`
+	// Updated is the time of the last light update.
+	Updated time.Time `json:"updated"`
+	// Error is the error of the last light update.
+	Error string `json:"error,omitempty"`
+	// Color is the color shown by the light, off means that the light is switched off.
+	Color string `json:"color,omitempty"`
+	// Sequence is the sequence run by the light.
+	Sequence string `json:"sequence,omitempty"`
+	// provisioned is true when sequences are provisioned in the light controller,
+	// provisionErr is the error of the last provisioning.
+	provisioned  bool
+	provisionErr error
+}
+
+// Readiness describes whether statuslight daemon is able to show statuses.
+type Readiness struct {
+	// Ready is true when status loop is running and all light controllers are reachable.
+	Ready bool `json:"ready"`
+	// Loop is the state of the status loop: running or stopped.
+	Loop   string           `json:"loop"`
+	Groups []GroupReadiness `json:"groups"`
+}
+
+// GroupReadiness describes whether the group light can be set.
+type GroupReadiness struct {
+	GroupLight
+	// Reachable is true when the light controller responds.
+	Reachable bool `json:"reachable"`
+	// ProbeError is the error of the light controller probe.
+	ProbeError string `json:"probeError,omitempty"`
+	// ProvisionError is the error of sequence provisioning, sequences are provisioned
+	// when the light controller becomes reachable.
+	ProvisionError string `json:"provisionError,omitempty"`
 }
 
 // StatusLight represents status context, it stores all details necessary to calculate current status.
 type StatusLight struct {
-	stats      map[string]bool
-	client     *milightdclient.Client
-	colors     StatusMap
-	sequences  StatusMap
-	brightness int
-	quit       chan struct{}
+	store      *statusStore
+	groups     []*lightGroup
+	ttl        time.Duration
+	aggregator Aggregator
+	stateFile  string
+	// saveMu serializes state file writes, so older snapshot never overwrites newer one.
+	saveMu      sync.Mutex
+	debounce    time.Duration
+	minInterval time.Duration
+	retryMax    time.Duration
+	reassert    time.Duration
+	schedule    *Schedule
+	escalation  escalation
+	// lights stores state of the lights published by the status loop.
+	lights          []GroupLight
+	lightsMu        sync.Mutex
+	offlineColor    string
+	offlineSequence string
+	staleAfter      time.Duration
+	staleColor      string
+	staleSequence   string
+	// sequences are provisioned in the light controllers.
+	sequences []models.Sequence
+	metrics   *metrics
+	events    *eventBus
+	// started is the time when status light was created, it is used by the watchdog before the first update.
+	started time.Time
+	changed chan struct{}
+	// cancel stops status loop, done is closed when status loop ends.
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 // NewStatusLight returns initialized StatusLight object.
-func NewStatusLight(miURL string, colors, sequences StatusMap, brightness int) *StatusLight {
+// Status loop runs until the context is canceled or StatusLight is closed.
+func NewStatusLight(ctx context.Context, cfg Config) (*StatusLight, error) {
+	if len(cfg.Groups) == 0 {
+		return nil, errors.New("no status groups configured")
+	}
+	capacity := cfg.MaxStatuses
+	if capacity <= 0 {
+		capacity = maxStatuses
+	}
 	statusLight := StatusLight{
-		stats:      make(map[string]bool),
-		client:     milightdclient.NewClient(miURL),
-		colors:     colors,
-		sequences:  sequences,
-		brightness: brightness,
-		quit:       make(chan struct{}),
+		store:           newStatusStore(capacity, cfg.Eviction),
+		ttl:             cfg.TTL,
+		aggregator:      cfg.Aggregator,
+		stateFile:       cfg.StateFile,
+		debounce:        cfg.Debounce,
+		minInterval:     cfg.MinInterval,
+		retryMax:        cfg.RetryMax,
+		reassert:        cfg.Reassert,
+		schedule:        cfg.Schedule,
+		offlineColor:    cfg.OfflineColor,
+		offlineSequence: cfg.OfflineSequence,
+		staleAfter:      cfg.StaleAfter,
+		staleColor:      cfg.StaleColor,
+		staleSequence:   cfg.StaleSequence,
+		sequences:       cfg.SequenceDefinitions,
+		metrics:         newMetrics(),
+		events:          newEventBus(),
+		started:         time.Now(),
+		changed:         make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+	esc, err := newEscalation(cfg.Escalations)
+	if err != nil {
+		return nil, fmt.Errorf("escalation rule: %s", err)
+	}
+	statusLight.escalation = esc
+	for _, g := range cfg.Groups {
+		if g.Name == "" {
+			return nil, errors.New("status group without name")
+		}
+		if statusLight.group(g.Name) != nil {
+			return nil, fmt.Errorf("duplicated status group: %s", g.Name)
+		}
+		group, err := newLightGroup(g)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %s", g.Name, err)
+		}
+		statusLight.groups = append(statusLight.groups, group)
+	}
+	for _, g := range statusLight.groups {
+		g.driver = &instrumentedDriver{driver: g.driver, group: g.name, metrics: statusLight.metrics, events: statusLight.events}
 	}
-	go statusLight.statusLoop()
-	return &statusLight
+	err = statusLight.provisionSequences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("sequence provisioning error: %s", err)
+	}
+	if cfg.StateFile != "" {
+		err := statusLight.restoreState(cfg.StateMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("state file error: %s", err)
+		}
+	}
+	ctx, statusLight.cancel = context.WithCancel(ctx)
+	go statusLight.statusLoop(ctx)
+	return &statusLight, nil
 }
 
-// Close terminates status loop.
+// provisionSequences creates or updates sequence definitions in the light controllers,
+// and checks that all sequences used by the groups are defined. Provisioning of the groups
+// with unreachable light controller is left to the status loop.
+func (c *StatusLight) provisionSequences(ctx context.Context) error {
+	for _, g := range c.groups {
+		err := c.provisionGroup(ctx, g)
+		if errors.Is(err, ErrUnreachable) {
+			log.Printf("group %s sequence provisioning deferred: %s", g.name, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("group %s: %s", g.name, err)
+		}
+	}
+	return nil
+}
+
+// provisionGroup creates or updates sequence definitions in the light controller of the group.
+func (c *StatusLight) provisionGroup(ctx context.Context, g *lightGroup) error {
+	provisioner, ok := g.driver.(SequenceProvisioner)
+	required := c.requiredSequences(g)
+	if !ok || (len(c.sequences) == 0 && len(required) == 0) {
+		g.provisioned = true
+		return nil
+	}
+	err := provisioner.ProvisionSequences(ctx, c.sequences, required)
+	g.provisioned, g.provisionErr = err == nil, err
+	return err
+}
+
+// requiredSequences returns names of all sequences used by the group light.
+func (c *StatusLight) requiredSequences(g *lightGroup) []string {
+	names := make(map[string]bool)
+	for _, name := range g.sequences {
+		names[name] = true
+	}
+	for _, rules := range c.escalation {
+		for _, r := range rules {
+			names[r.Sequence] = true
+		}
+	}
+	names[c.offlineSequence] = true
+	names[c.staleSequence] = true
+	delete(names, "")
+
+	var required []string
+	for name := range names {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	return required
+}
+
+// Close terminates status loop, it cancels light command in progress
+// and waits until offline light is set.
 func (c *StatusLight) Close() {
-	// Blocks until received.
-	c.quit <- struct{}{}
+	c.cancel()
+	<-c.done
+}
+
+// processStatus process status received by http server,
+// returns identifier of the status evicted to make room for the received one.
+func (c *StatusLight) processStatus(s StatusV2) (string, error) {
+	entry, err := c.newEntry(s, time.Now())
+	if err != nil {
+		return "", err
+	}
+	evicted, err := c.store.set(s.ID, entry)
+	if err != nil {
+		return "", err
+	}
+	if evicted != "" {
+		log.Printf("status %s evicted by %s", evicted, s.ID)
+		c.events.publish(EventRemove, RemoveEvent{ID: evicted, Reason: "evicted"})
+	}
+	c.events.publish(EventStatus, entry.info(s.ID))
+	c.saveState()
+	c.notify()
+	return evicted, nil
 }
 
-// processStatus process status received by http server.
-func (c *StatusLight) processStatus(s Status) error {
-	if len(c.stats) == maxStatuses {
-		return errTooMuchStatuses
+// processStatuses process batch of statuses received by http server, all statuses are applied at once
+// or none of them if any status is invalid. It returns identifiers of the statuses evicted to make room for the received ones.
+func (c *StatusLight) processStatuses(ss []StatusV2) ([]string, error) {
+	now := time.Now()
+	ids := make([]string, 0, len(ss))
+	entries := make([]statusEntry, 0, len(ss))
+	for _, s := range ss {
+		entry, err := c.newEntry(s, now)
+		if err != nil {
+			return nil, fmt.Errorf("status %s: %w", s.ID, err)
+		}
+		ids = append(ids, s.ID)
+		entries = append(entries, entry)
 	}
-	c.stats[s.ID] = s.State
+	evicted, err := c.store.setBatch(ids, entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range evicted {
+		log.Printf("status %s evicted by batch update", id)
+		c.events.publish(EventRemove, RemoveEvent{ID: id, Reason: "evicted"})
+	}
+	for i, id := range ids {
+		c.events.publish(EventStatus, entries[i].info(id))
+	}
+	c.saveState()
+	c.notify()
+	return evicted, nil
+}
+
+// newEntry validates received status and returns status entry updated at the specified time.
+func (c *StatusLight) newEntry(s StatusV2, now time.Time) (statusEntry, error) {
+	state, err := parseStatusType(s.State)
+	if err != nil {
+		return statusEntry{}, err
+	}
+	group := s.Group
+	if group == "" {
+		group = DefaultGroup
+	}
+	if c.group(group) == nil {
+		return statusEntry{}, errUnknownGroup
+	}
+	entry := statusEntry{
+		state:   state,
+		group:   group,
+		source:  s.Source,
+		updated: now,
+	}
+	ttl := c.ttl
+	if s.TTL > 0 {
+		ttl = time.Duration(s.TTL) * time.Second
+	}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	return entry, nil
+}
+
+// SnoozeStatus shows status as disabled for the specified duration, duration 0 ends snooze.
+// It returns false if there is no such status.
+func (c *StatusLight) SnoozeStatus(id string, d time.Duration) (StatusInfo, bool) {
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	e, ok := c.store.snooze(id, until)
+	if !ok {
+		return StatusInfo{}, false
+	}
+	if d > 0 {
+		log.Printf("status %s snoozed for %s", id, d)
+	} else {
+		log.Printf("status %s snooze ended", id)
+	}
+	info := e.info(id)
+	c.events.publish(EventStatus, info)
+	c.saveState()
+	c.notify()
+	return info, true
+}
+
+// subscribe returns channel receiving the current snapshot followed by status and light events,
+// and the function ending subscription. The channel is closed when status loop ends.
+func (c *StatusLight) subscribe() (<-chan Event, func()) {
+	events, cancel := c.events.subscribe()
+	ch := make(chan Event, 1)
+	// snapshot is taken after subscribing, so no change is missed
+	snapshot := Snapshot{
+		Statuses: c.Statuses(),
+		Light:    c.LightState(),
+	}
+	go func() {
+		defer close(ch)
+		ch <- Event{Type: EventSnapshot, Data: snapshot}
+		for e := range events {
+			ch <- e
+		}
+	}()
+	return ch, cancel
+}
+
+// Statuses returns all not expired statuses sorted by identifier.
+func (c *StatusLight) Statuses() []StatusInfo {
+	now := time.Now()
+	stats := c.store.snapshot()
+	res := make([]StatusInfo, 0, len(stats))
+	for id, e := range stats {
+		if e.expired(now) {
+			continue
+		}
+		res = append(res, e.info(id))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// Status returns status with the specified identifier, false means there is no such status.
+func (c *StatusLight) Status(id string) (StatusInfo, bool) {
+	e, ok := c.store.get(id)
+	if !ok || e.expired(time.Now()) {
+		return StatusInfo{}, false
+	}
+	return e.info(id), true
+}
+
+// DeleteStatus removes status with the specified identifier, returns false if there is no such status.
+func (c *StatusLight) DeleteStatus(id string) bool {
+	if !c.store.remove(id) {
+		return false
+	}
+	log.Printf("status %s deleted", id)
+	c.events.publish(EventRemove, RemoveEvent{ID: id, Reason: "deleted"})
+	c.saveState()
+	c.notify()
+	return true
+}
+
+// DeleteStatuses removes statuses with identifiers starting with prefix, empty prefix removes all statuses.
+// It returns sorted identifiers of deleted statuses.
+func (c *StatusLight) DeleteStatuses(prefix string) []string {
+	deleted := c.store.removePrefix(prefix)
+	if len(deleted) == 0 {
+		return deleted
+	}
+	for _, id := range deleted {
+		c.events.publish(EventRemove, RemoveEvent{ID: id, Reason: "deleted"})
+	}
+	if prefix == "" {
+		log.Printf("all %d statuses deleted", len(deleted))
+	} else {
+		log.Printf("%d statuses with prefix %s deleted", len(deleted), prefix)
+	}
+	c.saveState()
+	c.notify()
+	return deleted
+}
+
+// expireStatuses removes statuses expired at the specified time.
+func (c *StatusLight) expireStatuses(now time.Time) {
+	expired := c.store.expire(now)
+	for _, id := range expired {
+		log.Printf("status %s expired", id)
+		c.events.publish(EventRemove, RemoveEvent{ID: id, Reason: "expired"})
+	}
+	if len(expired) > 0 {
+		c.saveState()
+	}
+}
+
+// restoreState loads statuses from the state file, statuses older than maxAge are dropped.
+// Statuses are restored from the least recently updated, so the eviction policy keeps the most recent ones.
+func (c *StatusLight) restoreState(maxAge time.Duration) error {
+	stats, err := loadState(c.stateFile)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return stats[ids[i]].updated.Before(stats[ids[j]].updated)
+	})
+	now := time.Now()
+	for _, id := range ids {
+		e := stats[id]
+		switch {
+		case e.expired(now):
+			log.Printf("status %s from state file expired", id)
+		case maxAge > 0 && now.Sub(e.updated) > maxAge:
+			log.Printf("status %s from state file is stale", id)
+		case c.group(e.group) == nil:
+			log.Printf("status %s from state file refers to unknown group %s", id, e.group)
+		default:
+			evicted, err := c.store.set(id, e)
+			if err != nil {
+				log.Printf("status %s from state file dropped: %s", id, err)
+				continue
+			}
+			if evicted != "" {
+				log.Printf("status %s from state file evicted by %s", evicted, id)
+			}
+		}
+	}
+	log.Printf("%d statuses restored from %s", c.store.len(), c.stateFile)
 	return nil
 }
 
-// statusLoop is the main processing loop.
-func (c *StatusLight) statusLoop() {
-	// set status immediately
-	lastStatus := c.getStatus()
-	err := c.setStatus(lastStatus)
+// saveState writes statuses to the state file if persistence is enabled.
+func (c *StatusLight) saveState() {
+	if c.stateFile == "" {
+		return
+	}
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	err := saveState(c.stateFile, c.store.snapshot())
 	if err != nil {
-		log.Printf("statuslight.setStatus error: %s", err)
+		log.Printf("statuslight.saveState error: %s", err)
 	}
+}
+
+// group returns light group with the specified name, or nil if there is no such group.
+func (c *StatusLight) group(name string) *lightGroup {
+	for _, g := range c.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// statusLoop is the main processing loop.
+func (c *StatusLight) statusLoop(ctx context.Context) {
+	defer close(c.done)
+	// subscribers are notified about offline light before subscriptions end
+	defer c.events.close()
+
+	// set status immediately
+	c.updateLights(ctx, time.Now())
+	lastSet := time.Now()
+
+	ticker := time.NewTicker(setStatusPeriod)
+	defer ticker.Stop()
+
+	// update is armed when statuses changed and the lights should be updated
+	var update <-chan time.Time
 
 	for {
+		// retry is armed when any light failed to be set
+		var retry <-chan time.Time
+		if at, ok := c.nextRetry(); ok {
+			retry = time.After(time.Until(at))
+		}
+		// expiry is armed for the earliest status expiration or snooze end,
+		// every store change notifies the loop, so it is re-armed for new statuses
+		var expiry <-chan time.Time
+		if at, ok := c.store.nextChange(time.Now()); ok {
+			expiry = time.After(time.Until(at))
+		}
+
 		select {
-		case <-c.quit:
+		case <-ctx.Done():
+			c.setOffline()
 			return
-		case <-time.After(setStatusPeriod):
-			sts := c.getStatus()
-			if lastStatus != sts {
-				err = c.setStatus(sts)
-				if err != nil {
-					log.Printf("statuslight.setStatus error: %s", err)
-				} else {
-					lastStatus = sts
-				}
+		case <-c.changed:
+			// collect changes received within debounce window
+			if update == nil {
+				update = time.After(c.debounce)
+			}
+		case <-update:
+			update = nil
+			// don't flood milightd with commands
+			if wait := c.minInterval - time.Since(lastSet); wait > 0 {
+				update = time.After(wait)
+				continue
+			}
+			if c.updateLights(ctx, time.Now()) {
+				lastSet = time.Now()
+			}
+		case <-retry:
+			if c.updateLights(ctx, time.Now()) {
+				lastSet = time.Now()
+			}
+		case <-expiry:
+			c.expireStatuses(time.Now())
+			if c.updateLights(ctx, time.Now()) {
+				lastSet = time.Now()
+			}
+		case <-ticker.C:
+			c.expireStatuses(time.Now())
+			if c.updateLights(ctx, time.Now()) {
+				lastSet = time.Now()
 			}
 		}
 	}
 }
 
-// getStatus returns single status for all received statuses.
-func (c *StatusLight) getStatus() statusType {
-	var t, f int
-	for _, s := range c.stats {
-		switch s {
-		case true:
-			t++
-		case false:
-			f++
+// updateLights sets lights of the groups which status has changed, failed to be set before
+// or should be re-asserted, returns true if any command was sent to the light.
+func (c *StatusLight) updateLights(ctx context.Context, now time.Time) bool {
+	var sent bool
+	for _, g := range c.groups {
+		sts := c.getStatus(g.name, now)
+		if sts != g.current || g.since.IsZero() {
+			ev := AggregateEvent{Group: g.name, Status: sts.String(), Time: now}
+			if !g.since.IsZero() {
+				ev.Previous = g.current.String()
+			}
+			c.events.publish(EventAggregate, ev)
+			// escalation starts over with every status change
+			g.current, g.since = sts, now
+		}
+		state := lightState{
+			status: sts,
+			quiet:  c.schedule.quiet(now),
+			level:  c.escalation.level(sts, now.Sub(g.since)),
+			stale:  c.stale(now),
+		}
+		if g.synced && g.state == state && (c.reassert <= 0 || now.Sub(g.setAt) < c.reassert) {
+			continue
+		}
+		if !g.synced && g.state == state && now.Before(g.retryAt) {
+			// wait for retry
+			continue
+		}
+		if state.quiet != g.state.quiet {
+			log.Printf("group %s quiet mode: %t", g.name, state.quiet)
 		}
+		if state.stale != g.state.stale {
+			log.Printf("group %s stale: %t", g.name, state.stale)
+		}
+		if state.level > 0 && state.level != g.state.level {
+			log.Printf("group %s status %s escalated to level %d", g.name, state.status, state.level)
+		}
+		sent = true
+		g.state = state
+		g.updatedAt = now
+		var err error
+		if !g.provisioned {
+			err = c.provisionGroup(ctx, g)
+		}
+		if err != nil {
+			err = fmt.Errorf("sequence provisioning error: %s", err)
+		} else if state.stale && !state.quiet {
+			err = g.set(ctx, c.staleColor, c.staleSequence, g.brightness)
+		} else {
+			err = g.show(ctx, state, c.schedule, c.escalation)
+		}
+		g.err = err
+		if err != nil {
+			g.synced = false
+			g.backoff = nextBackoff(g.backoff, c.retryMax)
+			g.retryAt = now.Add(g.backoff)
+			log.Printf("statuslight.setStatus error: %s for group %s, retry in %s", err, g.name, g.backoff)
+		} else {
+			g.synced = true
+			g.backoff = 0
+			g.setAt = now
+			c.metrics.observeSet(now)
+		}
+	}
+	c.publishLights()
+	return sent
+}
+
+// publishLights stores copy of the lights state for the readers outside of status loop.
+func (c *StatusLight) publishLights() {
+	lights := make([]GroupLight, 0, len(c.groups))
+	for _, g := range c.groups {
+		lights = append(lights, GroupLight{
+			Group:    g.name,
+			Status:   g.state.status.String(),
+			Quiet:    g.state.quiet,
+			Stale:    g.state.stale,
+			Since:    g.since,
+			Level:    g.state.level,
+			Synced:   g.synced,
+			Updated:  g.updatedAt,
+			Error:    errorString(g.err),
+			Color:    g.color,
+			Sequence: g.sequence,
+
+			provisionErr: g.provisionErr,
+			provisioned:  g.provisioned,
+		})
+	}
+	c.lightsMu.Lock()
+	c.lights = lights
+	c.lightsMu.Unlock()
+}
+
+// LightState returns current state of the lights.
+func (c *StatusLight) LightState() LightState {
+	c.lightsMu.Lock()
+	defer c.lightsMu.Unlock()
+	now := time.Now()
+	return LightState{
+		Quiet:      c.schedule.quiet(now),
+		Stale:      c.stale(now),
+		LastUpdate: c.store.updated(),
+		Groups:     append([]GroupLight(nil), c.lights...),
 	}
-	res := StatusOK
-	if t > 0 {
-		if f > 0 {
-			res = StatusUnstable
+}
+
+// Readiness probes light controllers of all groups and reports state of the status loop.
+func (c *StatusLight) Readiness(ctx context.Context) Readiness {
+	res := Readiness{
+		Ready: true,
+		Loop:  "running",
+	}
+	select {
+	case <-c.done:
+		res.Ready = false
+		res.Loop = "stopped"
+	default:
+	}
+	lights := c.LightState().Groups
+	for i, g := range c.groups {
+		r := GroupReadiness{
+			Reachable: true,
 		}
-	} else {
-		if f > 0 {
-			res = StatusError
+		if i < len(lights) {
+			r.GroupLight = lights[i]
+			if !r.provisioned {
+				res.Ready = false
+				r.ProvisionError = errorString(r.provisionErr)
+			}
+		} else {
+			r.Group = g.name
 		}
+		if prober, ok := g.driver.(Prober); ok {
+			err := prober.Probe(ctx)
+			if err != nil {
+				res.Ready = false
+				r.Reachable = false
+				r.ProbeError = err.Error()
+			}
+		}
+		res.Groups = append(res.Groups, r)
 	}
 	return res
 }
 
-// setStatus send command to milightd daemon to set light according to provided status.
-func (c *StatusLight) setStatus(sts statusType) error {
-	sequence, _ := c.sequences[sts]
-	if sequence != "" {
-		return c.setSequence(sequence)
+// errorString returns error message, or empty string if there is no error.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// stale returns true if no status update arrived within watchdog window.
+func (c *StatusLight) stale(now time.Time) bool {
+	if c.staleAfter <= 0 {
+		return false
+	}
+	last := c.store.updated()
+	if last.Before(c.started) {
+		last = c.started
 	}
-	color, _ := c.colors[sts]
-	return c.setLight(color)
+	return now.Sub(last) > c.staleAfter
 }
 
-// setLight sets light through milightd.
-func (c *StatusLight) setLight(color string) error {
-	var light models.Light
+// setOffline sets offline light of all groups, if configured.
+func (c *StatusLight) setOffline() {
+	if c.offlineColor == "" && c.offlineSequence == "" {
+		return
+	}
+	// status loop context is already canceled
+	ctx, cancel := context.WithTimeout(context.Background(), offlineTimeout)
+	defer cancel()
+	for _, g := range c.groups {
+		err := g.set(ctx, c.offlineColor, c.offlineSequence, g.brightness)
+		if err != nil {
+			log.Printf("statuslight.setOffline error: %s for group %s", err, g.name)
+		}
+	}
+}
 
-	light.SetColor(color)
-	light.SetBrightness(c.brightness)
-	light.SetSwitch(true)
+// nextRetry returns the earliest time of retrying to set failed light.
+func (c *StatusLight) nextRetry() (time.Time, bool) {
+	var at time.Time
+	var ok bool
+	for _, g := range c.groups {
+		if g.synced {
+			continue
+		}
+		if !ok || g.retryAt.Before(at) {
+			at, ok = g.retryAt, true
+		}
+	}
+	return at, ok
+}
 
-	return c.client.SetLight(light)
+// nextBackoff returns retry delay following the previous one, the delay is doubled up to max.
+func nextBackoff(prev, max time.Duration) time.Duration {
+	next := 2 * prev
+	if next < minRetryPeriod {
+		next = minRetryPeriod
+	}
+	if max > 0 && next > max {
+		next = max
+	}
+	return next
 }
 
-// setSequence sets sequence of lights through milightd.
-func (c *StatusLight) setSequence(sequence string) error {
-	state := models.SequenceState{
-		Name:  sequence,
-		State: models.SeqRunning,
+// notify wakes up status loop to update the lights.
+func (c *StatusLight) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+		// status loop is already notified
 	}
-	return c.client.SetSequenceState(state)
+}
+
+// getStatus returns single status for all received statuses of the group at the specified time.
+func (c *StatusLight) getStatus(group string, now time.Time) statusType {
+	return c.aggregator.Aggregate(c.store.counts(group, now))
 }
@@ -0,0 +1,616 @@
+package statuslight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestStatusLight returns StatusLight connected to the fake milightd server,
+// both are closed when the test ends.
+func newTestStatusLight(t *testing.T) *StatusLight {
+	milightd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(milightd.Close)
+	aggregator, err := NewAggregator("mixed", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusLight, err := NewStatusLight(context.Background(), Config{
+		Groups: []GroupConfig{
+			{
+				Name:       DefaultGroup,
+				URL:        milightd.URL,
+				Colors:     StatusMap{StatusOK: "green", StatusUnstable: "yellow", StatusError: "red"},
+				Brightness: 32,
+			},
+		},
+		Aggregator: aggregator,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(statusLight.Close)
+	return statusLight
+}
+
+// newTestServer returns test StatusLight with HTTP test server of its API, setup configures the API server
+// before it starts. Both servers and StatusLight are closed when the test ends.
+func newTestServer(t *testing.T, setup func(s *HTTPServer)) (*StatusLight, *httptest.Server) {
+	statusLight := newTestStatusLight(t)
+	httpServer := NewHTTPServer(0, statusLight)
+	if setup != nil {
+		setup(httpServer)
+	}
+	srv := httptest.NewServer(httpServer.handler())
+	t.Cleanup(srv.Close)
+	return statusLight, srv
+}
+
+func TestProcessStatusConcurrently(t *testing.T) {
+	statusLight := newTestStatusLight(t)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < maxStatuses/2; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				s := StatusV2{
+					ID:    fmt.Sprintf("job-%d", n),
+					State: []string{"ok", "error", "unstable"}[j%3],
+				}
+				_, err := statusLight.processStatus(s)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	// readers of HTTP server share the store and the lights state with the writers and the status loop
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				statusLight.getStatus(DefaultGroup, time.Now())
+				statusLight.Statuses()
+				statusLight.LightState()
+				statusLight.writeMetrics(ioutil.Discard)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// the last update of every status is error
+	stats := statusLight.Statuses()
+	if len(stats) != maxStatuses/2 {
+		t.Fatalf("expected %d statuses, got %d", maxStatuses/2, len(stats))
+	}
+	for _, s := range stats {
+		if s.State != "error" {
+			t.Errorf("%s: expected %s, got %s", s.ID, "error", s.State)
+		}
+	}
+	if sts := statusLight.getStatus(DefaultGroup, time.Now()); sts != StatusError {
+		t.Errorf("expected %s, got %s", StatusError, sts)
+	}
+}
+
+func TestProcessStatusTooMuchStatuses(t *testing.T) {
+	statusLight := newTestStatusLight(t)
+
+	for i := 0; i < maxStatuses; i++ {
+		_, err := statusLight.processStatus(StatusV2{ID: fmt.Sprintf("job-%d", i), State: "ok"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := statusLight.processStatus(StatusV2{ID: "job", State: "ok"})
+	if err != errTooMuchStatuses {
+		t.Errorf("expected %s, got %v", errTooMuchStatuses, err)
+	}
+	// existing status can be updated even if there is no room for the new one
+	_, err = statusLight.processStatus(StatusV2{ID: "job-0", State: "error"})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// fakeDriver records light commands with their times, it fails while fail is set.
+// When started is set, the first command closes it and blocks until the command is canceled.
+type fakeDriver struct {
+	mu       sync.Mutex
+	commands []string
+	times    []time.Time
+	fail     bool
+	started  chan struct{}
+	blocked  bool
+}
+
+func (d *fakeDriver) command(ctx context.Context, cmd string) error {
+	d.mu.Lock()
+	if d.started != nil && !d.blocked {
+		d.blocked = true
+		close(d.started)
+		d.mu.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	defer d.mu.Unlock()
+	if d.fail {
+		return errors.New("light unreachable")
+	}
+	d.commands = append(d.commands, cmd)
+	d.times = append(d.times, time.Now())
+	return nil
+}
+
+// colors returns color commands with their times.
+func (d *fakeDriver) colors() ([]string, []time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var colors []string
+	var times []time.Time
+	for i, cmd := range d.commands {
+		if strings.HasPrefix(cmd, "color:") {
+			colors = append(colors, cmd)
+			times = append(times, d.times[i])
+		}
+	}
+	return colors, times
+}
+
+// waitColors waits until n color commands are recorded, it returns recorded color commands with their times.
+func (d *fakeDriver) waitColors(n int, timeout time.Duration) ([]string, []time.Time) {
+	deadline := time.Now().Add(timeout)
+	for {
+		colors, times := d.colors()
+		if len(colors) >= n || time.Now().After(deadline) {
+			return colors, times
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (d *fakeDriver) SetColor(ctx context.Context, color string) error {
+	return d.command(ctx, "color:"+color)
+}
+
+func (d *fakeDriver) SetBrightness(ctx context.Context, brightness int) error {
+	return d.command(ctx, fmt.Sprintf("brightness:%d", brightness))
+}
+
+func (d *fakeDriver) RunEffect(ctx context.Context, name string) error {
+	return d.command(ctx, "effect:"+name)
+}
+
+func (d *fakeDriver) Off(ctx context.Context) error {
+	return d.command(ctx, "off")
+}
+
+// newLoopLessStatusLight returns StatusLight without status loop, with single group using provided driver.
+func newLoopLessStatusLight(driver LightDriver) *StatusLight {
+	return &StatusLight{
+		store: newStatusStore(maxStatuses, EvictReject),
+		groups: []*lightGroup{
+			{
+				name:       DefaultGroup,
+				driver:     driver,
+				colors:     StatusMap{StatusOK: "green", StatusUnstable: "yellow", StatusError: "red"},
+				sequences:  StatusMap{},
+				brightness: 32,
+			},
+		},
+		aggregator: mixedAggregator{},
+		retryMax:   4 * time.Second,
+		reassert:   time.Minute,
+		changed:    make(chan struct{}, 1),
+	}
+}
+
+func TestUpdateLightsExpiration(t *testing.T) {
+	driver := &fakeDriver{}
+	c := newLoopLessStatusLight(driver)
+	c.reassert = 0
+	c.ttl = time.Minute
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	for _, s := range []StatusV2{
+		// daemon default TTL
+		{ID: "build", State: "error"},
+		// own TTL overrides daemon default
+		{ID: "deploy", State: "ok", TTL: 300},
+	} {
+		entry, err := c.newEntry(s, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.store.set(s.ID, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		at       time.Duration
+		status   statusType
+		commands []string
+	}{
+		{0, StatusUnstable, []string{"color:yellow", "brightness:32"}},
+		{59 * time.Second, StatusUnstable, nil},
+		{time.Minute, StatusOK, []string{"color:green", "brightness:32"}},
+		{299 * time.Second, StatusOK, nil},
+		// no statuses left
+		{5 * time.Minute, StatusOK, nil},
+	}
+	for _, tt := range tests {
+		at := now.Add(tt.at)
+		driver.commands = nil
+		c.expireStatuses(at)
+		c.updateLights(context.Background(), at)
+		if sts := c.getStatus(DefaultGroup, at); sts != tt.status {
+			t.Errorf("%s: expected %s, got %s", tt.at, tt.status, sts)
+		}
+		if fmt.Sprint(driver.commands) != fmt.Sprint(tt.commands) {
+			t.Errorf("%s: expected %v, got %v", tt.at, tt.commands, driver.commands)
+		}
+	}
+	if n := c.store.len(); n != 0 {
+		t.Errorf("expected no statuses, got %d", n)
+	}
+}
+
+func TestUpdateLightsGroups(t *testing.T) {
+	first := &fakeDriver{}
+	second := &fakeDriver{}
+	c := newLoopLessStatusLight(first)
+	c.reassert = 0
+	c.groups = append(c.groups, &lightGroup{
+		name:       "team-b",
+		driver:     second,
+		colors:     StatusMap{StatusOK: "white", StatusUnstable: "orange", StatusError: "purple"},
+		sequences:  StatusMap{},
+		brightness: 64,
+	})
+	now := time.Now()
+
+	tests := []struct {
+		status   StatusV2
+		defaults statusType
+		teamB    statusType
+		first    []string
+		second   []string
+	}{
+		// every group light is set on start
+		{StatusV2{}, StatusOK, StatusOK, []string{"color:green", "brightness:32"}, []string{"color:white", "brightness:64"}},
+		{StatusV2{ID: "deploy", State: "error", Group: "team-b"}, StatusOK, StatusError, nil, []string{"color:purple", "brightness:64"}},
+		{StatusV2{ID: "build", State: "unstable"}, StatusUnstable, StatusError, []string{"color:yellow", "brightness:32"}, nil},
+		{StatusV2{ID: "deploy", State: "ok", Group: "team-b"}, StatusUnstable, StatusOK, nil, []string{"color:white", "brightness:64"}},
+	}
+	for i, tt := range tests {
+		if tt.status.ID != "" {
+			if _, err := c.processStatus(tt.status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		first.commands, second.commands = nil, nil
+		at := now.Add(time.Duration(i) * time.Second)
+		c.updateLights(context.Background(), at)
+		if sts := c.getStatus(DefaultGroup, at); sts != tt.defaults {
+			t.Errorf("%d: expected %s group %s, got %s", i, DefaultGroup, tt.defaults, sts)
+		}
+		if sts := c.getStatus("team-b", at); sts != tt.teamB {
+			t.Errorf("%d: expected %s group %s, got %s", i, "team-b", tt.teamB, sts)
+		}
+		if fmt.Sprint(first.commands) != fmt.Sprint(tt.first) {
+			t.Errorf("%d: expected %s light %v, got %v", i, DefaultGroup, tt.first, first.commands)
+		}
+		if fmt.Sprint(second.commands) != fmt.Sprint(tt.second) {
+			t.Errorf("%d: expected %s light %v, got %v", i, "team-b", tt.second, second.commands)
+		}
+	}
+}
+
+func TestNewStatusLightGroups(t *testing.T) {
+	aggregator, err := NewAggregator("mixed", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name   string
+		groups []string
+		valid  bool
+	}{
+		{"named groups only", []string{"team-a", "team-b"}, true},
+		{"duplicated group", []string{"team-a", "team-a"}, false},
+		{"group without name", []string{"team-a", ""}, false},
+	}
+
+	for _, tt := range tests {
+		var groups []GroupConfig
+		for _, name := range tt.groups {
+			groups = append(groups, GroupConfig{Name: name, Driver: "noop"})
+		}
+		c, err := NewStatusLight(context.Background(), Config{Groups: groups, Aggregator: aggregator})
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %t, got %v", tt.name, tt.valid, err)
+		}
+		if err != nil {
+			continue
+		}
+		// statuses without group are rejected when there is no default group
+		if _, err = c.processStatus(StatusV2{ID: "build", State: "ok"}); err != errUnknownGroup {
+			t.Errorf("%s: expected %s, got %v", tt.name, errUnknownGroup, err)
+		}
+		if _, err = c.processStatus(StatusV2{ID: "build", State: "ok", Group: "team-b"}); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		c.Close()
+	}
+}
+
+// startStatusLoop runs status loop of the loop-less StatusLight until the test ends.
+func startStatusLoop(t *testing.T, c *StatusLight) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go c.statusLoop(ctx)
+	t.Cleanup(c.Close)
+}
+
+func TestStatusLoopExpiration(t *testing.T) {
+	driver := &fakeDriver{}
+	c := newLoopLessStatusLight(driver)
+	c.reassert = 0
+	startStatusLoop(t, c)
+
+	if colors, _ := driver.waitColors(1, time.Second); len(colors) != 1 {
+		t.Fatalf("expected initial light, got %v", colors)
+	}
+	if _, err := c.processStatus(StatusV2{ID: "build", State: "error", TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// expiration is shown long before the periodic check
+	colors, _ := driver.waitColors(3, 3*time.Second)
+	if fmt.Sprint(colors) != fmt.Sprint([]string{"color:green", "color:red", "color:green"}) {
+		t.Errorf("expected expired status to reset the light, got %v", colors)
+	}
+	if n := c.store.len(); n != 0 {
+		t.Errorf("expected no statuses, got %d", n)
+	}
+}
+
+func TestStatusLoopDebounce(t *testing.T) {
+	driver := &fakeDriver{}
+	c := newLoopLessStatusLight(driver)
+	c.reassert = 0
+	c.debounce = 50 * time.Millisecond
+	c.minInterval = 300 * time.Millisecond
+	startStatusLoop(t, c)
+
+	if colors, _ := driver.waitColors(1, time.Second); len(colors) != 1 {
+		t.Fatalf("expected initial light, got %v", colors)
+	}
+	time.Sleep(c.minInterval)
+
+	// burst of changes gives single light update with the final status
+	for _, state := range []string{"ok", "error", "unstable", "ok", "error"} {
+		if _, err := c.processStatus(StatusV2{ID: "build", State: state}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	driver.waitColors(2, time.Second)
+	time.Sleep(2 * c.debounce)
+	colors, _ := driver.colors()
+	if fmt.Sprint(colors) != fmt.Sprint([]string{"color:green", "color:red"}) {
+		t.Fatalf("expected single update of the burst, got %v", colors)
+	}
+
+	// change within minimal interval is delayed, not dropped
+	if _, err := c.processStatus(StatusV2{ID: "build", State: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	colors, times := driver.waitColors(3, 2*time.Second)
+	if fmt.Sprint(colors) != fmt.Sprint([]string{"color:green", "color:red", "color:green"}) {
+		t.Fatalf("expected delayed update, got %v", colors)
+	}
+	if d := times[2].Sub(times[1]); d < c.minInterval {
+		t.Errorf("expected update after %s, got %s", c.minInterval, d)
+	}
+}
+
+func TestUpdateLightsRetry(t *testing.T) {
+	driver := &fakeDriver{fail: true}
+	c := newLoopLessStatusLight(driver)
+	now := time.Now()
+
+	if !c.updateLights(context.Background(), now) {
+		t.Fatal("expected light command")
+	}
+	at, ok := c.nextRetry()
+	if !ok || !at.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected retry at %s, got %s", now.Add(time.Second), at)
+	}
+	// no retry before backoff elapses
+	if c.updateLights(context.Background(), now.Add(500*time.Millisecond)) {
+		t.Error("unexpected light command before retry")
+	}
+	// backoff is doubled up to max
+	for _, backoff := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		at, _ = c.nextRetry()
+		now = at
+		c.updateLights(context.Background(), now)
+		at, _ = c.nextRetry()
+		if !at.Equal(now.Add(backoff)) {
+			t.Errorf("expected retry at %s, got %s", now.Add(backoff), at)
+		}
+	}
+
+	driver.fail = false
+	at, _ = c.nextRetry()
+	now = at
+	if !c.updateLights(context.Background(), now) {
+		t.Fatal("expected light command")
+	}
+	if _, ok = c.nextRetry(); ok {
+		t.Error("unexpected retry after success")
+	}
+	if len(driver.commands) != 2 || driver.commands[0] != "color:green" {
+		t.Errorf("unexpected light commands: %v", driver.commands)
+	}
+}
+
+func TestUpdateLightsReassert(t *testing.T) {
+	driver := &fakeDriver{}
+	c := newLoopLessStatusLight(driver)
+	now := time.Now()
+
+	c.updateLights(context.Background(), now)
+	if c.updateLights(context.Background(), now.Add(30*time.Second)) {
+		t.Error("unexpected light command before re-assert period")
+	}
+	if !c.updateLights(context.Background(), now.Add(time.Minute)) {
+		t.Error("expected light command after re-assert period")
+	}
+	if len(driver.commands) != 4 {
+		t.Errorf("expected %d light commands, got %v", 4, driver.commands)
+	}
+}
+
+func TestUpdateLightsEscalation(t *testing.T) {
+	driver := &fakeDriver{}
+	c := newLoopLessStatusLight(driver)
+	c.reassert = 0
+	esc, err := newEscalation([]EscalationRule{
+		{Status: "error", After: 4 * time.Hour, Brightness: 100},
+		{Status: "error", After: 30 * time.Minute, Sequence: "blink"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.escalation = esc
+
+	now := time.Now()
+	if _, err = c.processStatus(StatusV2{ID: "job", State: "error"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		elapsed  time.Duration
+		commands []string
+	}{
+		{0, []string{"color:red", "brightness:32"}},
+		{29 * time.Minute, nil},
+		{30 * time.Minute, []string{"effect:blink"}},
+		{4 * time.Hour, []string{"effect:blink", "brightness:100"}},
+	}
+	for _, step := range steps {
+		driver.commands = nil
+		c.updateLights(context.Background(), now.Add(step.elapsed))
+		if fmt.Sprint(driver.commands) != fmt.Sprint(step.commands) {
+			t.Errorf("after %s: expected %v, got %v", step.elapsed, step.commands, driver.commands)
+		}
+	}
+	if g := c.groups[0]; g.sequence != "blink" || g.color != "" {
+		t.Errorf("expected light running %s, got color %q sequence %q", "blink", g.color, g.sequence)
+	}
+
+	// escalation starts over when status changes
+	if _, err = c.processStatus(StatusV2{ID: "job", State: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	c.updateLights(context.Background(), now.Add(5*time.Hour))
+	if _, err = c.processStatus(StatusV2{ID: "job", State: "error"}); err != nil {
+		t.Fatal(err)
+	}
+	driver.commands = nil
+	c.updateLights(context.Background(), now.Add(5*time.Hour+time.Minute))
+	if fmt.Sprint(driver.commands) != fmt.Sprint([]string{"color:red", "brightness:32"}) {
+		t.Errorf("expected escalation reset, got %v", driver.commands)
+	}
+}
+
+func TestCloseCancelsLightCommand(t *testing.T) {
+	driver := &fakeDriver{started: make(chan struct{})}
+	c := newLoopLessStatusLight(driver)
+	c.offlineColor = "white"
+	c.done = make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.statusLoop(ctx)
+
+	select {
+	case <-driver.started:
+	case <-time.After(time.Second):
+		t.Fatal("light command not started")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by light command in progress")
+	}
+
+	if fmt.Sprint(driver.commands) != fmt.Sprint([]string{"color:white", "brightness:32"}) {
+		t.Errorf("expected offline light, got %v", driver.commands)
+	}
+
+	// second close doesn't block
+	c.Close()
+}
+
+func TestUpdateLightsStale(t *testing.T) {
+	driver := &fakeDriver{}
+	c := newLoopLessStatusLight(driver)
+	c.reassert = 0
+	c.staleAfter = 10 * time.Minute
+	c.staleColor = "purple"
+	c.started = time.Now()
+
+	if _, err := c.processStatus(StatusV2{ID: "job", State: "error"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	c.updateLights(context.Background(), now)
+	if c.stale(now.Add(9 * time.Minute)) {
+		t.Error("unexpected stale data within watchdog window")
+	}
+
+	driver.commands = nil
+	c.updateLights(context.Background(), now.Add(11*time.Minute))
+	if fmt.Sprint(driver.commands) != fmt.Sprint([]string{"color:purple", "brightness:32"}) {
+		t.Errorf("expected stale light, got %v", driver.commands)
+	}
+
+	// status update ends stale data
+	if _, err := c.processStatus(StatusV2{ID: "job", State: "error"}); err != nil {
+		t.Fatal(err)
+	}
+	driver.commands = nil
+	c.updateLights(context.Background(), time.Now())
+	if fmt.Sprint(driver.commands) != fmt.Sprint([]string{"color:red", "brightness:32"}) {
+		t.Errorf("expected status light, got %v", driver.commands)
+	}
+}
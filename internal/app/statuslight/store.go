@@ -0,0 +1,268 @@
+package statuslight
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy defines how new status is stored when the store is full.
+type EvictionPolicy int
+
+const (
+	// EvictReject rejects new statuses when the store is full.
+	EvictReject EvictionPolicy = iota
+	// EvictLeastRecentlyUpdated removes the least recently updated status.
+	EvictLeastRecentlyUpdated
+	// EvictOldestExpired removes the status that expired first, it rejects new statuses when nothing has expired.
+	EvictOldestExpired
+)
+
+// ParseEvictionPolicy returns eviction policy with the specified name: reject, lru or expired.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "reject":
+		return EvictReject, nil
+	case "lru":
+		return EvictLeastRecentlyUpdated, nil
+	case "expired":
+		return EvictOldestExpired, nil
+	}
+	return EvictReject, fmt.Errorf("unknown eviction policy: %s", name)
+}
+
+// statusStore is a concurrency safe storage of received statuses.
+// Readers work on snapshots, so they never hold the lock while processing statuses.
+type statusStore struct {
+	mu       sync.RWMutex
+	stats    map[string]statusEntry
+	capacity int
+	eviction EvictionPolicy
+	// lastUpdate is the time of the most recent status update.
+	lastUpdate time.Time
+}
+
+// newStatusStore returns initialized statusStore object.
+func newStatusStore(capacity int, eviction EvictionPolicy) *statusStore {
+	return &statusStore{
+		stats:    make(map[string]statusEntry),
+		capacity: capacity,
+		eviction: eviction,
+	}
+}
+
+// set stores status entry, returns identifier of the status evicted to make room for the new one.
+// Existing statuses are always updated, new statuses may be rejected when the store is full.
+func (s *statusStore) set(id string, e statusEntry) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var evicted string
+	if _, ok := s.stats[id]; !ok && len(s.stats) >= s.capacity {
+		evicted = s.victim(s.stats, nil, time.Now())
+		if evicted == "" {
+			return "", errTooMuchStatuses
+		}
+		delete(s.stats, evicted)
+	}
+	if old, ok := s.stats[id]; ok && e.snoozed.IsZero() {
+		// snooze outlasts status updates
+		e.snoozed = old.snoozed
+	}
+	s.stats[id] = e
+	if e.updated.After(s.lastUpdate) {
+		s.lastUpdate = e.updated
+	}
+	return evicted, nil
+}
+
+// setBatch stores all status entries or none of them, returns identifiers of the statuses evicted
+// to make room for the new ones. Entries are applied to the copy of stored statuses,
+// so readers never see partially applied batch.
+func (s *statusStore) setBatch(ids []string, entries []statusEntry) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	distinct := make(map[string]bool)
+	for _, id := range ids {
+		distinct[id] = true
+	}
+	if len(distinct) > s.capacity {
+		return nil, errTooMuchStatuses
+	}
+	now := time.Now()
+	stats := make(map[string]statusEntry, len(s.stats)+len(distinct))
+	for id, e := range s.stats {
+		stats[id] = e
+	}
+	var evicted []string
+	lastUpdate := s.lastUpdate
+	for i, id := range ids {
+		if _, ok := stats[id]; !ok && len(stats) >= s.capacity {
+			// statuses of the batch are never evicted, they are stored by the batch anyway
+			victim := s.victim(stats, distinct, now)
+			if victim == "" {
+				return nil, errTooMuchStatuses
+			}
+			delete(stats, victim)
+			evicted = append(evicted, victim)
+		}
+		e := entries[i]
+		if old, ok := stats[id]; ok && e.snoozed.IsZero() {
+			e.snoozed = old.snoozed
+		}
+		stats[id] = e
+		if e.updated.After(lastUpdate) {
+			lastUpdate = entries[i].updated
+		}
+	}
+	s.stats = stats
+	s.lastUpdate = lastUpdate
+	return evicted, nil
+}
+
+// updated returns the time of the most recent status update.
+func (s *statusStore) updated() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastUpdate
+}
+
+// victim returns identifier of the status from stats to evict according to eviction policy,
+// statuses in exclude are skipped. Empty identifier means that nothing can be evicted.
+func (s *statusStore) victim(stats map[string]statusEntry, exclude map[string]bool, now time.Time) string {
+	var victim string
+	var oldest time.Time
+	for id, e := range stats {
+		if exclude[id] {
+			continue
+		}
+		var t time.Time
+		switch s.eviction {
+		case EvictLeastRecentlyUpdated:
+			t = e.updated
+		case EvictOldestExpired:
+			if !e.expired(now) {
+				continue
+			}
+			t = e.expires
+		default:
+			return ""
+		}
+		if victim == "" || t.Before(oldest) {
+			victim, oldest = id, t
+		}
+	}
+	return victim
+}
+
+// expire removes statuses expired at the specified time, returns identifiers of removed statuses.
+func (s *statusStore) expire(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []string
+	for id, e := range s.stats {
+		if e.expired(now) {
+			delete(s.stats, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// nextChange returns the earliest time after now when any status expires or its snooze ends,
+// false is returned if no status will change by itself.
+func (s *statusStore) nextChange(now time.Time) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var next time.Time
+	for _, e := range s.stats {
+		for _, t := range []time.Time{e.expires, e.snoozed} {
+			if t.After(now) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// get returns status entry with the specified identifier.
+func (s *statusStore) get(id string) (statusEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.stats[id]
+	return e, ok
+}
+
+// snooze sets the time until which status is shown as disabled, returns updated status entry
+// or false if there is no such status.
+func (s *statusStore) snooze(id string, until time.Time) (statusEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.stats[id]
+	if !ok {
+		return e, false
+	}
+	e.snoozed = until
+	s.stats[id] = e
+	return e, true
+}
+
+// remove deletes status entry with the specified identifier, returns false if there is no such status.
+func (s *statusStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.stats[id]; !ok {
+		return false
+	}
+	delete(s.stats, id)
+	return true
+}
+
+// removePrefix deletes status entries with identifiers starting with prefix, empty prefix deletes all entries.
+// It returns sorted identifiers of deleted statuses.
+func (s *statusStore) removePrefix(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := []string{}
+	for id := range s.stats {
+		if strings.HasPrefix(id, prefix) {
+			delete(s.stats, id)
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// len returns number of stored statuses.
+func (s *statusStore) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.stats)
+}
+
+// snapshot returns copy of all stored statuses.
+func (s *statusStore) snapshot() map[string]statusEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := make(map[string]statusEntry, len(s.stats))
+	for id, e := range s.stats {
+		stats[id] = e
+	}
+	return stats
+}
+
+// counts returns number of statuses of each type in the group, expired statuses are skipped.
+func (s *statusStore) counts(group string, now time.Time) map[statusType]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[statusType]int)
+	for _, e := range s.stats {
+		if e.group != group || e.expired(now) {
+			continue
+		}
+		counts[e.effective(now)]++
+	}
+	return counts
+}
@@ -0,0 +1,212 @@
+package statuslight
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusStoreConcurrentAccess(t *testing.T) {
+	store := newStatusStore(maxStatuses, EvictReject)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				e := statusEntry{
+					state:   StatusOK,
+					group:   DefaultGroup,
+					updated: time.Now(),
+				}
+				if j%2 == 0 {
+					e.expires = time.Now()
+				}
+				// store is full most of the time, so errors are expected
+				store.set(fmt.Sprintf("job-%d", (n+j)%maxStatuses), e)
+			}
+		}(i)
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				store.expire(time.Now())
+				store.counts(DefaultGroup, time.Now())
+				for id := range store.snapshot() {
+					_ = id
+				}
+				store.len()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := store.len(); n > maxStatuses {
+		t.Errorf("expected at most %d statuses, got %d", maxStatuses, n)
+	}
+}
+
+func TestStatusStoreSnapshotIsCopy(t *testing.T) {
+	store := newStatusStore(maxStatuses, EvictReject)
+	_, err := store.set("job", statusEntry{state: StatusOK, group: DefaultGroup})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := store.snapshot()
+	delete(snapshot, "job")
+
+	if n := store.len(); n != 1 {
+		t.Errorf("expected %d, got %d", 1, n)
+	}
+}
+
+func TestStatusStoreExpire(t *testing.T) {
+	store := newStatusStore(maxStatuses, EvictReject)
+	now := time.Now()
+	store.set("expired", statusEntry{state: StatusError, group: DefaultGroup, expires: now})
+	store.set("alive", statusEntry{state: StatusOK, group: DefaultGroup, expires: now.Add(time.Minute)})
+
+	expired := store.expire(now)
+	if len(expired) != 1 || expired[0] != "expired" {
+		t.Errorf("expected %v, got %v", []string{"expired"}, expired)
+	}
+	counts := store.counts(DefaultGroup, now)
+	if counts[StatusOK] != 1 || counts[StatusError] != 0 {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+}
+
+func TestStatusStoreNextChange(t *testing.T) {
+	store := newStatusStore(maxStatuses, EvictReject)
+	now := time.Now()
+	if at, ok := store.nextChange(now); ok {
+		t.Errorf("unexpected change at %s", at)
+	}
+
+	store.set("forever", statusEntry{state: StatusOK, group: DefaultGroup})
+	store.set("expires", statusEntry{state: StatusOK, group: DefaultGroup, expires: now.Add(time.Hour)})
+	store.set("snoozed", statusEntry{state: StatusError, group: DefaultGroup, expires: now.Add(2 * time.Hour), snoozed: now.Add(time.Minute)})
+	store.set("expired", statusEntry{state: StatusError, group: DefaultGroup, expires: now})
+
+	if at, ok := store.nextChange(now); !ok || !at.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected change at %s, got %s", now.Add(time.Minute), at)
+	}
+	if at, ok := store.nextChange(now.Add(time.Minute)); !ok || !at.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected change at %s, got %s", now.Add(time.Hour), at)
+	}
+	if at, ok := store.nextChange(now.Add(2 * time.Hour)); ok {
+		t.Errorf("unexpected change at %s", at)
+	}
+}
+
+func TestStatusStoreEviction(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		eviction EvictionPolicy
+		evicted  string
+		err      error
+	}{
+		{EvictReject, "", errTooMuchStatuses},
+		{EvictLeastRecentlyUpdated, "first", nil},
+		{EvictOldestExpired, "second", nil},
+	}
+
+	for _, test := range tests {
+		store := newStatusStore(3, test.eviction)
+		store.set("first", statusEntry{state: StatusOK, updated: now.Add(-3 * time.Minute)})
+		store.set("second", statusEntry{state: StatusOK, updated: now.Add(-2 * time.Minute), expires: now.Add(-time.Minute)})
+		store.set("third", statusEntry{state: StatusOK, updated: now.Add(-time.Minute), expires: now.Add(-time.Second)})
+
+		evicted, err := store.set("fourth", statusEntry{state: StatusOK, updated: now})
+		if err != test.err {
+			t.Errorf("policy %d: expected %v, got %v", test.eviction, test.err, err)
+		}
+		if evicted != test.evicted {
+			t.Errorf("policy %d: expected %q, got %q", test.eviction, test.evicted, evicted)
+		}
+	}
+}
+
+func TestStatusStoreOldestExpiredRejects(t *testing.T) {
+	store := newStatusStore(1, EvictOldestExpired)
+	store.set("alive", statusEntry{state: StatusOK, updated: time.Now()})
+
+	_, err := store.set("new", statusEntry{state: StatusOK, updated: time.Now()})
+	if err != errTooMuchStatuses {
+		t.Errorf("expected %s, got %v", errTooMuchStatuses, err)
+	}
+}
+
+func TestStatusStoreSetBatch(t *testing.T) {
+	store := newStatusStore(3, EvictReject)
+	now := time.Now()
+	e := statusEntry{state: StatusOK, group: DefaultGroup, updated: now}
+
+	if _, err := store.set("a", e); err != nil {
+		t.Fatal(err)
+	}
+	// batch exceeding capacity is rejected as a whole
+	_, err := store.setBatch([]string{"a", "b", "c", "d"}, []statusEntry{e, e, e, e})
+	if err != errTooMuchStatuses {
+		t.Errorf("expected %s, got %v", errTooMuchStatuses, err)
+	}
+	if store.len() != 1 {
+		t.Errorf("expected %d statuses, got %d", 1, store.len())
+	}
+
+	failed := statusEntry{state: StatusError, group: DefaultGroup, updated: now.Add(time.Second)}
+	if _, err = store.setBatch([]string{"a", "b", "c"}, []statusEntry{failed, e, e}); err != nil {
+		t.Fatal(err)
+	}
+	if store.len() != 3 || store.snapshot()["a"].state != StatusError {
+		t.Errorf("unexpected statuses: %v", store.snapshot())
+	}
+	if !store.updated().Equal(failed.updated) {
+		t.Errorf("expected %s, got %s", failed.updated, store.updated())
+	}
+}
+
+func TestStatusStoreSetBatchEviction(t *testing.T) {
+	store := newStatusStore(2, EvictLeastRecentlyUpdated)
+	now := time.Now()
+
+	store.set("old", statusEntry{state: StatusOK, group: DefaultGroup, updated: now.Add(-time.Hour)})
+	store.set("new", statusEntry{state: StatusOK, group: DefaultGroup, updated: now.Add(-time.Minute)})
+
+	e := statusEntry{state: StatusOK, group: DefaultGroup, updated: now}
+	evicted, err := store.setBatch([]string{"a", "b"}, []statusEntry{e, e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(evicted) != fmt.Sprint([]string{"old", "new"}) {
+		t.Errorf("unexpected evicted statuses: %v", evicted)
+	}
+
+	// the least recently updated status is in the batch, so the next one is evicted
+	store = newStatusStore(3, EvictLeastRecentlyUpdated)
+	store.set("a", statusEntry{state: StatusOK, group: DefaultGroup, updated: now.Add(-time.Hour)})
+	store.set("b", statusEntry{state: StatusOK, group: DefaultGroup, updated: now.Add(-time.Minute)})
+	store.set("x", statusEntry{state: StatusOK, group: DefaultGroup, updated: now.Add(-time.Second)})
+
+	evicted, err = store.setBatch([]string{"c", "a"}, []statusEntry{e, e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(evicted) != fmt.Sprint([]string{"b"}) {
+		t.Errorf("unexpected evicted statuses: %v", evicted)
+	}
+	for _, id := range []string{"a", "c", "x"} {
+		if _, ok := store.get(id); !ok {
+			t.Errorf("expected %s status", id)
+		}
+	}
+}
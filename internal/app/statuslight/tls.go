@@ -0,0 +1,158 @@
+package statuslight
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// TLSConfig defines TLS serving of the HTTP server.
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM encoded server certificate chain and private key,
+	// they are reloaded by HTTPServer.ReloadTLS.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is PEM encoded CA certificates verifying client certificates,
+	// empty file name disables client certificates.
+	ClientCAFile string
+	// RequireClientCert rejects connections without valid client certificate.
+	RequireClientCert bool
+}
+
+// serverTLS serves server certificate, which can be replaced while the server is running.
+type serverTLS struct {
+	cfg       TLSConfig
+	clientCAs *x509.CertPool
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+}
+
+// newServerTLS returns initialized serverTLS object.
+func newServerTLS(cfg TLSConfig) (*serverTLS, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("missing certificate or key file")
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("client certificates required without client CA file")
+	}
+	t := &serverTLS{
+		cfg: cfg,
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.clientCAs = pool
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload loads server certificate and key, the current certificate is kept on error.
+func (t *serverTLS) reload() error {
+	cert, err := tls.LoadX509KeyPair(t.cfg.CertFile, t.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert = &cert
+	return nil
+}
+
+// config returns TLS configuration of the server.
+func (t *serverTLS) config() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			return t.cert, nil
+		},
+	}
+	if t.clientCAs != nil {
+		cfg.ClientCAs = t.clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.cfg.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg
+}
+
+// loadCertPool reads PEM encoded certificates from the file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(path + ": no certificates found")
+	}
+	return pool, nil
+}
+
+// ClientACL stores permissions of client certificates.
+type ClientACL struct {
+	names map[string]token
+}
+
+// LoadClientACL reads permissions of client certificates from the file, it has the format of the token file
+// with certificate common name, DNS name, email address or URI in place of token value.
+func LoadClientACL(path string) (*ClientACL, error) {
+	acl := &ClientACL{
+		names: make(map[string]token),
+	}
+
+	err := readFields(path, func(fields []string) error {
+		t, err := parseToken("name", fields)
+		if err != nil {
+			return err
+		}
+		if _, ok := acl.names[fields[0]]; ok {
+			return errors.New("duplicated name")
+		}
+		acl.names[fields[0]] = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// lookup returns permissions of the verified client certificate of the request. Common name is matched first,
+// then DNS names, email addresses and URIs in certificate order.
+func (a *ClientACL) lookup(r *http.Request) (*token, bool) {
+	if a == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, false
+	}
+	for _, name := range certificateNames(r.TLS.VerifiedChains[0][0]) {
+		if t, ok := a.names[name]; ok {
+			return &t, true
+		}
+	}
+	return nil, false
+}
+
+// certificateNames returns common name and subject alternative names of the certificate.
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
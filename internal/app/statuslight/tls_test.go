@@ -0,0 +1,330 @@
+package statuslight
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// certFile is PEM encoded CA certificate.
+	certFile string
+	serial   int64
+}
+
+// newTestCA returns CA with self-signed certificate written to the temporary directory.
+func newTestCA(t *testing.T, name string) *testCA {
+	dir, err := ioutil.TempDir("", "statuslight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ca := &testCA{t: t, dir: dir, serial: 1}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.key = key
+	ca.certFile = filepath.Join(dir, name+".pem")
+	ca.write(ca.certFile, "CERTIFICATE", der)
+	return ca
+}
+
+// write writes PEM encoded block to the file.
+func (ca *testCA) write(path, typ string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+// issue writes certificate and key files of the certificate signed by CA, template sets names and usage.
+func (ca *testCA) issue(name string, template *x509.Certificate) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	certFile := filepath.Join(ca.dir, name+".pem")
+	keyFile := filepath.Join(ca.dir, name+"-key.pem")
+	ca.write(certFile, "CERTIFICATE", der)
+	ca.write(keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// server writes certificate and key files of the server certificate valid for localhost.
+func (ca *testCA) server(name string) (string, string) {
+	return ca.issue(name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// client returns client certificate signed by CA.
+func (ca *testCA) client(template *x509.Certificate) tls.Certificate {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	certFile, keyFile := ca.issue("client", template)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert
+}
+
+// startTLSServer starts HTTPServer on random local port, it returns server URL.
+func startTLSServer(t *testing.T, s *HTTPServer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	})
+	return "https://" + ln.Addr().String()
+}
+
+// tlsClient returns HTTP client trusting CA and sending client certificates.
+func tlsClient(t *testing.T, ca *testCA, certs ...tls.Certificate) *http.Client {
+	pool, err := loadCertPool(ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	statusLight := newTestStatusLight(t)
+
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.server("first")
+
+	httpServer := NewHTTPServer(0, statusLight)
+	if err := httpServer.ReloadTLS(); err == nil {
+		t.Error("expected error of disabled TLS")
+	}
+	if err := httpServer.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Fatal(err)
+	}
+	url := startTLSServer(t, httpServer)
+	client := tlsClient(t, ca)
+
+	serverName := func() string {
+		resp, err := client.Get(url + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if name := serverName(); name != "first" {
+		t.Errorf("expected first, got %s", name)
+	}
+
+	// certificate files are replaced in place, like by certificate renewal
+	newCert, newKey := ca.server("second")
+	if err := os.Rename(newCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if name := serverName(); name != "first" {
+		t.Errorf("expected first before reload, got %s", name)
+	}
+	if err := httpServer.ReloadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if name := serverName(); name != "second" {
+		t.Errorf("expected second, got %s", name)
+	}
+
+	// broken certificate keeps the current one
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := httpServer.ReloadTLS(); err == nil {
+		t.Error("expected error of broken certificate")
+	}
+	if name := serverName(); name != "second" {
+		t.Errorf("expected second, got %s", name)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	statusLight := newTestStatusLight(t)
+
+	ca := newTestCA(t, "ca")
+	other := newTestCA(t, "other")
+	certFile, keyFile := ca.server("server")
+
+	tokens, err := LoadTokens(writeTokens(t, "writer write\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := LoadClientACL(writeTokens(t, "ci write jobs/\nreporter.example.com write\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := NewHTTPServer(0, statusLight)
+	httpServer.SetTokens(tokens)
+	httpServer.SetClientACL(acl)
+	err = httpServer.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.certFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := startTLSServer(t, httpServer)
+
+	ci := ca.client(&x509.Certificate{Subject: pkix.Name{CommonName: "ci"}})
+	reporter := ca.client(&x509.Certificate{Subject: pkix.Name{CommonName: "host"}, DNSNames: []string{"reporter.example.com"}})
+	unknown := ca.client(&x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}})
+	untrusted := other.client(&x509.Certificate{Subject: pkix.Name{CommonName: "ci"}})
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		token  string
+		id     string
+		code   int
+	}{
+		{"common name", tlsClient(t, ca, ci), "", "jobs/first", http.StatusOK},
+		{"common name prefix", tlsClient(t, ca, ci), "", "other", http.StatusForbidden},
+		{"dns name", tlsClient(t, ca, reporter), "", "other", http.StatusOK},
+		{"unknown certificate", tlsClient(t, ca, unknown), "", "other", http.StatusUnauthorized},
+		{"unknown certificate with token", tlsClient(t, ca, unknown), "writer", "other", http.StatusOK},
+		// client doesn't send certificate of CA not accepted by the server
+		{"untrusted certificate", tlsClient(t, ca, untrusted), "", "jobs/first", http.StatusUnauthorized},
+		{"no certificate", tlsClient(t, ca), "", "other", http.StatusUnauthorized},
+		{"no certificate with token", tlsClient(t, ca), "writer", "other", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", url+"/api/v2/status", bytes.NewBufferString(`{"statusId":"`+tt.id+`","state":"ok"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := tt.client.Do(req)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, resp.StatusCode)
+		}
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	statusLight := newTestStatusLight(t)
+
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.server("server")
+
+	httpServer := NewHTTPServer(0, statusLight)
+	if err := httpServer.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true}); err == nil {
+		t.Error("expected error of missing client CA")
+	}
+	err := httpServer.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.certFile, RequireClientCert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := startTLSServer(t, httpServer)
+
+	if resp, err := tlsClient(t, ca).Get(url + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Error("expected handshake error without client certificate")
+	}
+
+	resp, err := tlsClient(t, ca, ca.client(&x509.Certificate{Subject: pkix.Name{CommonName: "any"}})).Get(url + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestLoadClientACL(t *testing.T) {
+	acl, err := LoadClientACL(writeTokens(t, "# comment\nci write jobs/\nspiffe://example.com/dashboard read\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok := acl.names["ci"]; tok.scope != ScopeWrite || tok.prefix != "jobs/" {
+		t.Errorf("unexpected permissions %+v", tok)
+	}
+	if tok := acl.names["spiffe://example.com/dashboard"]; tok.scope != ScopeRead || tok.prefix != "" {
+		t.Errorf("unexpected permissions %+v", tok)
+	}
+
+	for _, content := range []string{"ci", "ci owner", "ci read\nci write"} {
+		if _, err = LoadClientACL(writeTokens(t, content)); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
@@ -2,18 +2,69 @@ package statuslightclient
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/sgrzywna/statuslight/internal/app/statuslight"
 )
 
+// ErrNotFound is returned when the requested status is not known to the status light daemon.
+var ErrNotFound = errors.New("statuslight client: status not found")
+
+// ErrSignatureRejected is returned when the status light daemon rejects signature of the request.
+var ErrSignatureRejected = errors.New("statuslight client: signature rejected")
+
+// ErrTooMuchStatuses is returned when the status light daemon has no room for new statuses.
+var ErrTooMuchStatuses = errors.New("statuslight client: too much statuses")
+
+// Signer signs status submissions with the key shared with the status light daemon.
+type Signer struct {
+	keyID  string
+	secret []byte
+}
+
+// NewSigner returns initialized Signer object.
+func NewSigner(keyID, secret string) *Signer {
+	return &Signer{
+		keyID:  keyID,
+		secret: []byte(secret),
+	}
+}
+
+// Sign adds signature of the body to the request headers, every signature gets random nonce.
+func (s *Signer) Sign(req *http.Request, body []byte) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(statuslight.SignatureKeyHeader, s.keyID)
+	req.Header.Set(statuslight.SignatureTimestampHeader, timestamp)
+	req.Header.Set(statuslight.SignatureNonceHeader, nonce)
+	req.Header.Set(statuslight.SignatureHeader, statuslight.Signature(s.secret, timestamp, nonce, body))
+	return nil
+}
+
 // Client represents HTTP client to control status light daemon.
 type Client struct {
 	url    string
 	client *http.Client
+	// token is the API token sent with every request, empty token is not sent.
+	token string
+	// signer signs status submissions, nil signer sends them unsigned.
+	signer *Signer
 }
 
 // NewClient returns initialized Client object.
@@ -26,34 +77,235 @@ func NewClient(url string) *Client {
 	}
 }
 
+// TLSOptions defines TLS connection to the status light daemon.
+type TLSOptions struct {
+	// CAFile is PEM encoded CA certificates verifying the daemon certificate, empty file name uses system CAs.
+	CAFile string
+	// CertFile and KeyFile are PEM encoded client certificate and private key,
+	// empty file names send no client certificate.
+	CertFile string
+	KeyFile  string
+}
+
+// SetTLS sets CA certificates and client certificate used to connect to the status light daemon over HTTPS.
+func (c *Client) SetTLS(opts TLSOptions) error {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.CAFile != "" {
+		data, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("statuslight client: no certificates found in %s", opts.CAFile)
+		}
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	c.client.Transport = transport
+	return nil
+}
+
+// SetToken sets API token sent with every request as bearer token.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// SetSigner sets signer of status submissions. Signed submissions don't need API token.
+func (c *Client) SetSigner(signer *Signer) {
+	c.signer = signer
+}
+
 // SetStatus sets status on remote status light daemon.
-func (c *Client) SetStatus(id string, status bool) error {
+func (c *Client) SetStatus(ctx context.Context, id string, status bool) error {
 	s := statuslight.Status{
 		State: status,
 		ID:    id,
 	}
+	return c.post(ctx, "/api/v1/status", s)
+}
+
+// SetState sets status with enumerated state on remote status light daemon.
+// State is one of: ok, unstable, error, running, unknown, disabled.
+func (c *Client) SetState(ctx context.Context, id string, state string) error {
+	return c.SetGroupState(ctx, "", id, state)
+}
+
+// SetGroupState sets status with enumerated state in the specified status group on remote status light daemon.
+func (c *Client) SetGroupState(ctx context.Context, group, id string, state string) error {
+	s := statuslight.StatusV2{
+		State: state,
+		ID:    id,
+		Group: group,
+	}
+	return c.post(ctx, "/api/v2/status", s)
+}
+
+// SetStatuses sets batch of statuses with enumerated states on remote status light daemon,
+// all statuses are applied at once or none of them.
+func (c *Client) SetStatuses(ctx context.Context, statuses []statuslight.StatusV2) error {
+	return c.post(ctx, "/api/v1/statuses", statuses)
+}
+
+// Statuses returns all statuses known to remote status light daemon.
+func (c *Client) Statuses(ctx context.Context) ([]statuslight.StatusInfo, error) {
+	var stats []statuslight.StatusInfo
+	err := c.do(ctx, "GET", "/api/v1/status", &stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Status returns status with the specified identifier from remote status light daemon,
+// ErrNotFound is returned if there is no such status.
+func (c *Client) Status(ctx context.Context, id string) (*statuslight.StatusInfo, error) {
+	var s statuslight.StatusInfo
+	err := c.do(ctx, "GET", "/api/v1/status/"+url.PathEscape(id), &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SnoozeStatus shows status with the specified identifier as disabled on remote status light daemon
+// for the specified duration, rounded down to seconds. Duration 0 ends snooze.
+// ErrNotFound is returned if there is no such status.
+func (c *Client) SnoozeStatus(ctx context.Context, id string, d time.Duration) error {
+	s := statuslight.Snooze{
+		Duration: int(d / time.Second),
+	}
+	return c.post(ctx, "/api/v1/status/"+url.PathEscape(id)+"/snooze", s)
+}
+
+// DeleteStatus removes status with the specified identifier from remote status light daemon,
+// ErrNotFound is returned if there is no such status.
+func (c *Client) DeleteStatus(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/api/v1/status/"+url.PathEscape(id), nil)
+}
+
+// DeleteStatuses removes statuses with identifiers starting with prefix from remote status light daemon,
+// it returns identifiers of deleted statuses.
+func (c *Client) DeleteStatuses(ctx context.Context, prefix string) ([]string, error) {
+	if prefix == "" {
+		return nil, errors.New("statuslight client: empty prefix")
+	}
+	return c.deleteStatuses(ctx, url.Values{"prefix": {prefix}})
+}
+
+// Reset removes all statuses from remote status light daemon, it returns identifiers of deleted statuses.
+func (c *Client) Reset(ctx context.Context) ([]string, error) {
+	return c.deleteStatuses(ctx, url.Values{"all": {"true"}})
+}
+
+// deleteStatuses removes statuses selected by the query from remote status light daemon.
+func (c *Client) deleteStatuses(ctx context.Context, query url.Values) ([]string, error) {
+	var resp struct {
+		Deleted []string `json:"deleted"`
+	}
+	err := c.do(ctx, "DELETE", "/api/v1/status?"+query.Encode(), &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Deleted, nil
+}
 
-	d, err := json.Marshal(s)
+// do sends request without body to the remote status light daemon,
+// JSON encoded response is decoded to v unless v is nil.
+func (c *Client) do(ctx context.Context, method, path string, v interface{}) error {
+	url := fmt.Sprintf("%s%s", c.url, path)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("%s/api/v1/status", c.url)
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(d))
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("statuslight client: unexpected status code: %d", resp.StatusCode)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// send sends request to the remote status light daemon, it adds API token if it is set.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.client.Do(req)
+}
+
+// signed stores paths of status submissions accepting signatures.
+var signed = map[string]bool{
+	"/api/v1/status":   true,
+	"/api/v1/statuses": true,
+	"/api/v2/status":   true,
+}
+
+// post sends JSON encoded value to the remote status light daemon.
+func (c *Client) post(ctx context.Context, path string, v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s%s", c.url, path)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(d))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.client.Do(req)
+	if c.signer != nil && signed[path] {
+		if err = c.signer.Sign(req, d); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.send(req)
 	if err != nil {
 		return err
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		var rejection statuslight.SignatureRejection
+		if json.NewDecoder(resp.Body).Decode(&rejection) == nil && rejection.Reason != "" {
+			return fmt.Errorf("%w: %s", ErrSignatureRejected, rejection.Reason)
+		}
+	}
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return ErrTooMuchStatuses
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("statuslight client: unexpected status code: %d", resp.StatusCode)
 	}